@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrAccountSuspended = errors.New("account suspended")
+
+// purgeDueDeletions permanently removes accounts whose grace period is over.
+func purgeDueDeletions(ctx context.Context, store Store) (int64, error) {
+	ids, err := store.UsersDueForDeletion(ctx, nowRFC3339())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, id := range ids {
+		found, err := store.DeleteUser(ctx, id)
+		if err != nil {
+			return n, err
+		}
+		if found {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkManageable parses :id and rejects targets the caller may not act on.
+// It writes the error response itself and returns 0 in that case.
+func (h *AuthHandlers) checkManageable(c *gin.Context) int64 {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return 0
+	}
+	if targetID == getUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot manage your own account"})
+		return 0
+	}
+
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return 0
+	}
+	if ok, err := outranks(ctx, h.Store, actorPerms, targetID); err != nil || !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot manage this user"})
+		return 0
+	}
+	return targetID
+}
+
+// suspend marks the user suspended, optionally scheduling deletion, and
+// ends their sessions.
+func (h *AuthHandlers) suspend(c *gin.Context, deleteAfter string) {
+	ctx := c.Request.Context()
+	targetID := h.checkManageable(c)
+	if targetID == 0 {
+		return
+	}
+
+	found, err := h.Store.SuspendUser(ctx, targetID, nowRFC3339(), deleteAfter)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if deleteAfter != "" {
+		writeAudit(h.Store, c, getUserID(c), auditUserScheduleDelete, auditTarget("user", targetID), gin.H{"deleteAfter": deleteAfter})
+		c.JSON(http.StatusOK, gin.H{"deleteAfter": deleteAfter})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditUserSuspend, auditTarget("user", targetID), nil)
+	c.Status(http.StatusNoContent)
+}
+
+// POST /api/admin/users/:id/suspend
+func (h *AuthHandlers) SuspendUserAdmin(c *gin.Context) {
+	h.suspend(c, "")
+}
+
+// POST /api/admin/users/:id/schedule-deletion
+func (h *AuthHandlers) ScheduleDeletionAdmin(c *gin.Context) {
+	h.suspend(c, time.Now().UTC().Add(h.Cfg.AccountDeletionGrace).Format(time.RFC3339))
+}
+
+// POST /api/admin/users/:id/reactivate (also cancels a scheduled deletion)
+func (h *AuthHandlers) ReactivateUserAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID := h.checkManageable(c)
+	if targetID == 0 {
+		return
+	}
+
+	found, err := h.Store.ReactivateUser(ctx, targetID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditUserReactivate, auditTarget("user", targetID), nil)
+
+	c.Status(http.StatusNoContent)
+}
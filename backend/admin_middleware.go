@@ -1,19 +1,24 @@
 package main
 
 import (
-	"database/sql"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AdminRequired(db *sql.DB) gin.HandlerFunc {
+// RequirePermission lets the request through only if one of the caller's
+// roles grants perm.
+func RequirePermission(store Store, perm string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := getUserID(c)
-
-		var v int
-		if err := db.QueryRow(`SELECT is_admin FROM users WHERE id = ?`, userID).Scan(&v); err != nil || v != 1 {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+		ctx := c.Request.Context()
+		perms, err := store.UserPermissions(ctx, getUserID(c))
+		if err != nil {
+			internalError(c, "db error", err)
+			c.Abort()
+			return
+		}
+		if !hasPermission(perms, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing permission " + perm})
 			return
 		}
 
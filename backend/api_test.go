@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createdID is the body of a 201 from the create endpoints.
+type createdID struct {
+	ID int64 `json:"id"`
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	ts := newTestServer(t, nil)
+	aliceID := ts.createUser(t, "alice@example.com", "alice-password", false)
+
+	c := ts.client(t)
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+	c.call(http.MethodPost, "/api/login", gin.H{"email": "alice@example.com", "password": "wrong"}, http.StatusUnauthorized, nil)
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+
+	me := c.login("Alice@Example.com", "alice-password")
+	if me.UserID != aliceID || me.IsAdmin || me.CSRFToken == "" {
+		t.Fatalf("me: %+v", me)
+	}
+
+	// logging out takes the CSRF token too
+	token := c.csrf
+	c.csrf = ""
+	c.call(http.MethodPost, "/api/logout", nil, http.StatusForbidden, nil)
+	c.call(http.MethodGet, "/api/me", nil, http.StatusOK, nil)
+
+	c.csrf = token
+	c.call(http.MethodPost, "/api/logout", nil, http.StatusNoContent, nil)
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+}
+
+// A client cannot dodge the per-IP lockout by making up X-Forwarded-For;
+// the header only counts when the peer is a trusted proxy.
+func TestLoginThrottleClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		proxies string
+		locked  bool
+	}{
+		{"no trusted proxies", "", true},
+		{"from a trusted proxy", "127.0.0.1", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, map[string]string{"LOGIN_MAX_FAILURES_PER_IP": "2", "TRUSTED_PROXIES": tt.proxies})
+			c := ts.client(t)
+			for i := 1; i <= 2; i++ {
+				c.header = http.Header{"X-Forwarded-For": {fmt.Sprintf("203.0.113.%d", i)}}
+				c.call(http.MethodPost, "/api/login", gin.H{"email": fmt.Sprintf("u%d@example.com", i), "password": "wrong"}, http.StatusUnauthorized, nil)
+			}
+
+			c.header = http.Header{"X-Forwarded-For": {"203.0.113.3"}}
+			want := http.StatusUnauthorized
+			if tt.locked {
+				want = http.StatusTooManyRequests
+			}
+			c.call(http.MethodPost, "/api/login", gin.H{"email": "u3@example.com", "password": "wrong"}, want, nil)
+		})
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+	c := ts.client(t)
+	c.login("alice@example.com", "alice-password")
+	token := c.csrf
+	note := gin.H{"title": "t", "content": "c"}
+
+	c.csrf = ""
+	c.call(http.MethodPost, "/api/notes", note, http.StatusForbidden, nil)
+	c.csrf = "not-the-token"
+	c.call(http.MethodPost, "/api/notes", note, http.StatusForbidden, nil)
+
+	// the right token from the wrong site is still refused
+	c.csrf, c.origin = token, "https://evil.example"
+	c.call(http.MethodPost, "/api/notes", note, http.StatusForbidden, nil)
+
+	c.origin = ts.URL
+	c.call(http.MethodPost, "/api/notes", note, http.StatusCreated, nil)
+
+	// every session has its own token
+	other := ts.client(t)
+	if other.login("alice@example.com", "alice-password"); other.csrf == token {
+		t.Fatal("two sessions share a CSRF token")
+	}
+}
+
+func TestNotesAndSharing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+	ts.createUser(t, "bob@example.com", "bob-password", false)
+	alice := ts.client(t)
+	alice.login("alice@example.com", "alice-password")
+	bob := ts.client(t)
+	bob.login("bob@example.com", "bob-password")
+
+	var created createdID
+	alice.call(http.MethodPost, "/api/notes", gin.H{"title": "Groceries", "content": "milk"}, http.StatusCreated, &created)
+	path := fmt.Sprintf("/api/notes/%d", created.ID)
+	alice.call(http.MethodPut, path, gin.H{"title": "Groceries", "content": "milk, eggs"}, http.StatusNoContent, nil)
+
+	var notes []noteDTO
+	alice.call(http.MethodGet, "/api/notes", nil, http.StatusOK, &notes)
+	if len(notes) != 1 || notes[0].ID != created.ID || notes[0].Content != "milk, eggs" {
+		t.Fatalf("alice's notes: %+v", notes)
+	}
+	var note noteDTO
+	alice.call(http.MethodGet, path, nil, http.StatusOK, &note)
+	if note.Title != "Groceries" || note.Role != wsRoleOwner {
+		t.Fatalf("note: %+v", note)
+	}
+
+	// other users cannot see it, let alone change it
+	bob.call(http.MethodGet, "/api/notes", nil, http.StatusOK, &notes)
+	if len(notes) != 0 {
+		t.Fatalf("bob sees %+v", notes)
+	}
+	bob.call(http.MethodGet, path, nil, http.StatusNotFound, nil)
+	bob.call(http.MethodPut, path, gin.H{"title": "mine"}, http.StatusNotFound, nil)
+	bob.call(http.MethodPost, path+"/share", nil, http.StatusNotFound, nil)
+	bob.call(http.MethodDelete, path, nil, http.StatusNotFound, nil)
+
+	// a share link opens the note to anyone, until it is disabled
+	var share struct {
+		Token string `json:"token"`
+	}
+	alice.call(http.MethodPost, path+"/share", nil, http.StatusOK, &share)
+	anon := ts.client(t)
+	var shared map[string]any
+	anon.call(http.MethodGet, "/api/share/"+share.Token, nil, http.StatusOK, &shared)
+	if len(shared) != 4 || shared["title"] != "Groceries" || shared["content"] != "milk, eggs" ||
+		shared["createdAt"] != note.CreatedAt || shared["updatedAt"] != note.UpdatedAt {
+		t.Fatalf("shared note: %+v, want only title, content, createdAt and updatedAt", shared)
+	}
+	alice.call(http.MethodPost, path+"/share/disable", nil, http.StatusNoContent, nil)
+	anon.call(http.MethodGet, "/api/share/"+share.Token, nil, http.StatusNotFound, nil)
+
+	// re-enabling brings back the same link
+	var again struct {
+		Token string `json:"token"`
+	}
+	alice.call(http.MethodPost, path+"/share", nil, http.StatusOK, &again)
+	if again.Token != share.Token {
+		t.Fatalf("re-enabled link has token %q, want %q", again.Token, share.Token)
+	}
+
+	alice.call(http.MethodDelete, path, nil, http.StatusNoContent, nil)
+	alice.call(http.MethodGet, path, nil, http.StatusNotFound, nil)
+	anon.call(http.MethodGet, "/api/share/"+share.Token, nil, http.StatusNotFound, nil)
+}
+
+func TestWorkspaces(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+	bobID := ts.createUser(t, "bob@example.com", "bob-password", false)
+	ts.createUser(t, "carol@example.com", "carol-password", false)
+	alice := ts.client(t)
+	alice.login("alice@example.com", "alice-password")
+	bob := ts.client(t)
+	bob.login("bob@example.com", "bob-password")
+	carol := ts.client(t)
+	carol.login("carol@example.com", "carol-password")
+
+	var ws createdID
+	alice.call(http.MethodPost, "/api/workspaces", gin.H{"name": "Team"}, http.StatusCreated, &ws)
+	wsPath := fmt.Sprintf("/api/workspaces/%d", ws.ID)
+	var note createdID
+	alice.call(http.MethodPost, "/api/notes", gin.H{"title": "Plan", "workspaceId": ws.ID}, http.StatusCreated, &note)
+	notesPath := fmt.Sprintf("/api/notes?workspace=%d", ws.ID)
+	bob.call(http.MethodGet, notesPath, nil, http.StatusNotFound, nil)
+
+	var invite struct {
+		InviteURL string `json:"inviteUrl"`
+	}
+	alice.call(http.MethodPost, wsPath+"/invitations", gin.H{"email": "Bob@Example.com", "role": wsRoleViewer}, http.StatusCreated, &invite)
+	token := invite.InviteURL[len("/invite/"):]
+	invPath := "/api/invitations/" + url.PathEscape(token)
+
+	var inv struct {
+		WorkspaceName string `json:"workspaceName"`
+		Email         string `json:"email"`
+		Role          string `json:"role"`
+	}
+	bob.call(http.MethodGet, invPath, nil, http.StatusOK, &inv)
+	if inv.WorkspaceName != "Team" || inv.Email != "bob@example.com" || inv.Role != wsRoleViewer {
+		t.Fatalf("invitation: %+v", inv)
+	}
+	// only the invited account can accept, and only once
+	carol.call(http.MethodPost, invPath+"/accept", nil, http.StatusForbidden, nil)
+	bob.call(http.MethodPost, invPath+"/accept", nil, http.StatusOK, nil)
+	bob.call(http.MethodPost, invPath+"/accept", nil, http.StatusNotFound, nil)
+	alice.call(http.MethodPost, wsPath+"/invitations", gin.H{"email": "bob@example.com", "role": wsRoleEditor}, http.StatusConflict, nil)
+
+	var notes []noteDTO
+	bob.call(http.MethodGet, notesPath, nil, http.StatusOK, &notes)
+	if len(notes) != 1 || notes[0].ID != note.ID {
+		t.Fatalf("bob's view of the workspace: %+v", notes)
+	}
+	var members []struct {
+		UserID int64  `json:"userId"`
+		Role   string `json:"role"`
+	}
+	bob.call(http.MethodGet, wsPath+"/members", nil, http.StatusOK, &members)
+	if len(members) != 2 {
+		t.Fatalf("members: %+v", members)
+	}
+
+	// viewers read; editors write
+	notePath := fmt.Sprintf("/api/notes/%d", note.ID)
+	bob.call(http.MethodPut, notePath, gin.H{"title": "Bob's plan"}, http.StatusForbidden, nil)
+	bob.call(http.MethodPost, "/api/notes", gin.H{"title": "x", "workspaceId": ws.ID}, http.StatusForbidden, nil)
+	alice.call(http.MethodPut, fmt.Sprintf("%s/members/%d", wsPath, bobID), gin.H{"role": wsRoleEditor}, http.StatusNoContent, nil)
+	bob.call(http.MethodPut, notePath, gin.H{"title": "Bob's plan"}, http.StatusNoContent, nil)
+
+	carol.call(http.MethodGet, notePath, nil, http.StatusNotFound, nil)
+	carol.call(http.MethodGet, wsPath+"/members", nil, http.StatusNotFound, nil)
+}
+
+func TestAdminUsers(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "root@example.com", "root-password", true)
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+
+	alice := ts.client(t)
+	alice.login("alice@example.com", "alice-password")
+	alice.call(http.MethodGet, "/api/admin/users", nil, http.StatusForbidden, nil)
+	alice.call(http.MethodPost, "/api/admin/users", gin.H{"email": "eve@example.com", "password": "eve-password"}, http.StatusForbidden, nil)
+
+	root := ts.client(t)
+	if me := root.login("root@example.com", "root-password"); !me.IsAdmin {
+		t.Fatalf("root: %+v", me)
+	}
+	root.call(http.MethodPost, "/api/admin/users", gin.H{"email": "Dan@Example.com", "password": "dan-password"}, http.StatusCreated, nil)
+	root.call(http.MethodPost, "/api/admin/users", gin.H{"email": "dan@example.com", "password": "dan-password"}, http.StatusBadRequest, nil)
+
+	type userRow struct {
+		ID          int64  `json:"id"`
+		Email       string `json:"email"`
+		SuspendedAt string `json:"suspendedAt"`
+	}
+	var users []userRow
+	root.call(http.MethodGet, "/api/admin/users?q=dan", nil, http.StatusOK, &users)
+	if len(users) != 1 || users[0].Email != "dan@example.com" {
+		t.Fatalf("users matching dan: %+v", users)
+	}
+	danPath := fmt.Sprintf("/api/admin/users/%d", users[0].ID)
+
+	dan := ts.client(t)
+	dan.login("dan@example.com", "dan-password")
+
+	// suspension ends the user's sessions and keeps them out
+	root.call(http.MethodPost, danPath+"/suspend", nil, http.StatusNoContent, nil)
+	dan.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+	ts.client(t).call(http.MethodPost, "/api/login", gin.H{"email": "dan@example.com", "password": "dan-password"}, http.StatusForbidden, nil)
+	root.call(http.MethodGet, "/api/admin/users?q=dan", nil, http.StatusOK, &users)
+	if users[0].SuspendedAt == "" {
+		t.Fatalf("dan after suspension: %+v", users[0])
+	}
+
+	root.call(http.MethodPost, danPath+"/reactivate", nil, http.StatusNoContent, nil)
+	dan.login("dan@example.com", "dan-password")
+
+	root.call(http.MethodDelete, danPath, nil, http.StatusNoContent, nil)
+	dan.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+	root.call(http.MethodGet, "/api/admin/users?q=dan", nil, http.StatusOK, &users)
+	if len(users) != 0 {
+		t.Fatalf("dan after deletion: %+v", users)
+	}
+}
+
+func TestDatabaseErrorsAreReported(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+	alice := ts.client(t)
+	alice.login("alice@example.com", "alice-password")
+	var note createdID
+	alice.call(http.MethodPost, "/api/notes", gin.H{"title": "t"}, http.StatusCreated, &note)
+	path := fmt.Sprintf("/api/notes/%d", note.ID)
+	alice.call(http.MethodPost, path+"/share", nil, http.StatusOK, nil)
+
+	// a broken database is a 500 the user can quote, not a missing note or
+	// a silent success
+	if _, err := ts.DB.Exec(`DROP TABLE share_links`); err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		RequestID string `json:"requestId"`
+	}
+	alice.call(http.MethodPost, path+"/share/disable", nil, http.StatusInternalServerError, &body)
+	if body.RequestID == "" {
+		t.Fatal("500 without a request ID")
+	}
+	alice.call(http.MethodGet, path, nil, http.StatusInternalServerError, nil)
+	if _, err := ts.DB.Exec(`ALTER TABLE workspace_members RENAME TO members_gone`); err != nil {
+		t.Fatal(err)
+	}
+	alice.call(http.MethodGet, path, nil, http.StatusInternalServerError, nil)
+
+	if _, err := ts.DB.Exec(`ALTER TABLE notes RENAME TO notes_gone`); err != nil {
+		t.Fatal(err)
+	}
+	ts.client(t).call(http.MethodGet, "/api/share/any-token", nil, http.StatusInternalServerError, nil)
+}
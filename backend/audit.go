@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit actions. Targets are written as "<kind>:<id>", e.g. "user:12".
+const (
+	auditLoginSuccess          = "login.success"
+	auditLoginFailure          = "login.failure"
+	auditUserCreate            = "user.create"
+	auditUserUpdate            = "user.update"
+	auditUserDelete            = "user.delete"
+	auditUserSetAdmin          = "user.set_admin"
+	auditUserSetRoles          = "user.set_roles"
+	auditUserSuspend           = "user.suspend"
+	auditUserScheduleDelete    = "user.schedule_deletion"
+	auditUserReactivate        = "user.reactivate"
+	auditUserExport            = "user.export"
+	auditUserSelfDelete        = "user.self_delete"
+	auditPasswordResetIssue    = "password_reset.issue"
+	auditPasswordResetFinish   = "password_reset.complete"
+	auditSessionRevoke         = "session.revoke"
+	auditLockoutClear          = "lockout.clear"
+	auditRoleCreate            = "role.create"
+	auditRoleUpdate            = "role.update"
+	auditRoleDelete            = "role.delete"
+	auditImpersonationStart    = "impersonation.start"
+	auditImpersonationEnd      = "impersonation.end"
+	auditShareEnable           = "share.enable"
+	auditShareDisable          = "share.disable"
+	auditWorkspaceCreate       = "workspace.create"
+	auditWorkspaceDelete       = "workspace.delete"
+	auditWorkspaceInvite       = "workspace.invite"
+	auditWorkspaceJoin         = "workspace.join"
+	auditWorkspaceMemberRole   = "workspace.member_role"
+	auditWorkspaceMemberRemove = "workspace.member_remove"
+	auditExport                = "audit.export"
+	auditBackupCreate          = "backup.create"
+	auditBackupDownload        = "backup.download"
+)
+
+func auditTarget(kind string, id int64) string {
+	return kind + ":" + strconv.FormatInt(id, 10)
+}
+
+// writeAudit appends an entry to audit_log. actorID is 0 for anonymous
+// requests. A failed write is logged rather than returned: the action it
+// describes has already happened.
+//
+// The actor's email is copied into the entry so it stays readable after the
+// account is deleted. Entries made from an impersonation session carry its
+// ID in details.
+func writeAudit(store Store, c *gin.Context, actorID int64, action, target string, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	if id := c.GetInt64(ginImpersonationKey); id != 0 {
+		details["impersonationId"] = id
+	}
+	// keep the request's trace but not its cancellation: the action being
+	// recorded has already happened even if the client has gone away
+	appendAudit(context.WithoutCancel(c.Request.Context()), store, actorID, c.ClientIP(), action, target, details)
+}
+
+// appendAudit is writeAudit for callers without a request, such as the
+// admin CLI.
+func appendAudit(ctx context.Context, store Store, actorID int64, ip, action, target string, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	b, err := json.Marshal(details)
+	if err != nil {
+		slog.ErrorContext(ctx, "audit write failed", "action", action, "error", err)
+		return
+	}
+
+	err = store.AppendAudit(ctx, AuditEntry{
+		ActorID: actorID, IP: ip, Action: action, Target: target, Details: string(b), CreatedAt: nowRFC3339(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "audit write failed", "action", action, "error", err)
+	}
+}
+
+type AuditHandlers struct {
+	DB    *sql.DB
+	Store Store
+}
+
+func NewAuditHandlers(db *sql.DB, store Store) *AuditHandlers {
+	return &AuditHandlers{DB: db, Store: store}
+}
+
+type auditEntryDTO struct {
+	ID         int64           `json:"id"`
+	ActorID    int64           `json:"actorId"`
+	ActorEmail string          `json:"actorEmail"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	IP         string          `json:"ip"`
+	CreatedAt  string          `json:"createdAt"`
+	Details    json.RawMessage `json:"details"`
+}
+
+// auditFilter builds the WHERE clause shared by List and Export from
+// ?actor=&action=&target=&since=&until=. An action ending in "." matches
+// every action with that prefix, e.g. "user.".
+func auditFilter(c *gin.Context) (string, []any, bool) {
+	where := ` WHERE 1=1`
+	args := []any{}
+
+	if v := c.Query("actor"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, false
+		}
+		where += ` AND actor_id = ?`
+		args = append(args, id)
+	}
+	if v := c.Query("action"); v != "" {
+		if v[len(v)-1] == '.' {
+			where += ` AND LOWER(action) LIKE LOWER(?) ESCAPE '\'`
+			args = append(args, escapeLike(v)+"%")
+		} else {
+			where += ` AND action = ?`
+			args = append(args, v)
+		}
+	}
+	if v := c.Query("target"); v != "" {
+		where += ` AND target = ?`
+		args = append(args, v)
+	}
+	for _, p := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		v := c.Query(p.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", nil, false
+		}
+		where += ` AND created_at ` + p.op + ` ?`
+		args = append(args, t.UTC().Format(time.RFC3339))
+	}
+	return where, args, true
+}
+
+// GET /api/admin/audit?actor=&action=&target=&since=&until=&page=&pageSize=
+// Newest first; the total number of matches is in the X-Total-Count header.
+func (h *AuditHandlers) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	where, args, ok := auditFilter(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad filter"})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+
+	var total int
+	if err := h.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_log`+where, args...).Scan(&total); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT id, actor_id, actor_email, action, target, ip, created_at, details
+		FROM audit_log`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, pageSize, (page-1)*pageSize)...,
+	)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer rows.Close()
+
+	out := []auditEntryDTO{}
+	for rows.Next() {
+		var e auditEntryDTO
+		var details string
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorEmail, &e.Action, &e.Target, &e.IP, &e.CreatedAt, &details); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		e.Details = json.RawMessage(details)
+		out = append(out, e)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// GET /api/admin/audit/export?actor=&action=&target=&since=&until=
+// Streams every matching entry, oldest first, as JSON Lines.
+func (h *AuditHandlers) Export(c *gin.Context) {
+	ctx := c.Request.Context()
+	where, args, ok := auditFilter(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad filter"})
+		return
+	}
+
+	// written before the read starts, since SQLite cannot commit it while
+	// the export query is still open
+	writeAudit(h.Store, c, getUserID(c), auditExport, "", gin.H{"query": c.Request.URL.RawQuery})
+
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT id, actor_id, actor_email, action, target, ip, created_at, details
+		FROM audit_log`+where+` ORDER BY id ASC`,
+		args...,
+	)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102T150405Z")+`.jsonl"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for rows.Next() {
+		var e auditEntryDTO
+		var details string
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorEmail, &e.Action, &e.Target, &e.IP, &e.CreatedAt, &details); err != nil {
+			requestLogger(c).Error("audit export failed", "error", err)
+			return
+		}
+		e.Details = json.RawMessage(details)
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		requestLogger(c).Error("audit export failed", "error", err)
+	}
+}
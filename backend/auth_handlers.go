@@ -1,19 +1,23 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandlers struct {
-	DB  *sql.DB
-	Cfg Config
+	Store          Store
+	Cfg            Config
+	Passwords      *Passwords
+	Throttle       *LoginThrottle
+	Authenticators []Authenticator
 }
 
 type createUserReq struct {
@@ -26,8 +30,14 @@ type adminFlagReq struct {
 	IsAdmin bool `json:"isAdmin"`
 }
 
-func NewAuthHandlers(db *sql.DB, cfg Config) *AuthHandlers {
-	return &AuthHandlers{DB: db, Cfg: cfg}
+func NewAuthHandlers(store Store, cfg Config, pw *Passwords) *AuthHandlers {
+	return &AuthHandlers{
+		Store:          store,
+		Cfg:            cfg,
+		Passwords:      pw,
+		Throttle:       NewLoginThrottle(store, cfg),
+		Authenticators: newAuthenticators(store, cfg, pw),
+	}
 }
 
 type authReq struct {
@@ -36,25 +46,29 @@ type authReq struct {
 }
 
 func (h *AuthHandlers) Register(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req authReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
 		return
 	}
 	req.Email = strings.TrimSpace(strings.ToLower(req.Email))
-	if req.Email == "" || len(req.Password) < 6 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email required, password min 6"})
+	if req.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email required"})
+		return
+	}
+	if err := h.Passwords.Validate(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := h.Passwords.Hash(req.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "hash error"})
+		internalError(c, "hash error", err)
 		return
 	}
 
-	_, err = h.DB.Exec(`INSERT INTO users(email, password_hash, created_at) VALUES(?,?,?)`, req.Email, string(hash), nowRFC3339())
-	if err != nil {
+	if err := h.Store.CreateUser(ctx, &User{Email: req.Email, CreatedAt: nowRFC3339()}, hash); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "user exists or db error"})
 		return
 	}
@@ -63,6 +77,12 @@ func (h *AuthHandlers) Register(c *gin.Context) {
 }
 
 func (h *AuthHandlers) Login(c *gin.Context) {
+	ctx := c.Request.Context()
+	if h.Cfg.PasswordLoginDisabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "password login disabled"})
+		return
+	}
+
 	var req authReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
@@ -74,42 +94,117 @@ func (h *AuthHandlers) Login(c *gin.Context) {
 		return
 	}
 
-	var userID int64
-	var passHash string
-	err := h.DB.QueryRow(`SELECT id, password_hash FROM users WHERE email = ?`, req.Email).Scan(&userID, &passHash)
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(passHash), []byte(req.Password)) != nil {
+	ip := c.ClientIP()
+	wait, err := h.Throttle.Check(ctx, ip, req.Email)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if wait > 0 {
+		logins.WithLabelValues("password", "throttled").Inc()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many login attempts"})
+		return
+	}
+
+	userID, err := authenticate(c.Request.Context(), h.Authenticators, req.Email, req.Password)
+	if errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrBadPassword) {
+		reason := "bad_password"
+		if errors.Is(err, ErrUnknownUser) {
+			reason = "unknown_user"
+		}
+		if err := h.Throttle.RecordFailure(ctx, ip, req.Email, reason); err != nil {
+			requestLogger(c).Warn("login throttle", "error", err)
+		}
+		writeAudit(h.Store, c, 0, auditLoginFailure, "", gin.H{"email": req.Email, "reason": reason})
+		logins.WithLabelValues("password", "failure").Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
+	if err != nil {
+		internalError(c, "auth backend error", err)
+		return
+	}
+	if err := h.Throttle.RecordSuccess(ctx, req.Email); err != nil {
+		requestLogger(c).Warn("login throttle", "error", err)
+	}
+
+	if err := h.startSession(c, userID); errors.Is(err, ErrAccountSuspended) {
+		logins.WithLabelValues("password", "failure").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+		return
+	} else if err != nil {
+		internalError(c, "session error", err)
+		return
+	}
+	writeAudit(h.Store, c, userID, auditLoginSuccess, auditTarget("user", userID), gin.H{"method": "password"})
+	logins.WithLabelValues("password", "success").Inc()
+
+	c.Status(http.StatusNoContent)
+}
+
+// startSession creates a session for userID and sets its cookie. It returns
+// ErrAccountSuspended for suspended users.
+func (h *AuthHandlers) startSession(c *gin.Context, userID int64) error {
+	ctx := c.Request.Context()
+	u, err := h.Store.UserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.SuspendedAt != "" {
+		return ErrAccountSuspended
+	}
 
 	token, err := randomTokenURLSafe(32)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "token error"})
-		return
+		return err
+	}
+	csrfToken, err := randomTokenURLSafe(32)
+	if err != nil {
+		return err
 	}
 
-	expiresAt := time.Now().UTC().Add(h.Cfg.SessionTTL).Format(time.RFC3339)
-	_, err = h.DB.Exec(
-		`INSERT INTO sessions(user_id, token, expires_at, created_at) VALUES(?,?,?,?)`,
-		userID, token, expiresAt, nowRFC3339(),
-	)
+	now := time.Now().UTC()
+	expiresAt := sessionExpiry(h.Cfg, now, now)
+	err = h.Store.CreateSession(ctx, &Session{
+		UserID:     userID,
+		Token:      token,
+		CSRFToken:  csrfToken,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now.Format(time.RFC3339),
+		LastSeenAt: now.Format(time.RFC3339),
+		ExpiresAt:  expiresAt.Format(time.RFC3339),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-		return
+		return err
 	}
 
-	// Gin cookie: maxAge in seconds
-	maxAge := int(h.Cfg.SessionTTL.Seconds())
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(h.Cfg.CookieName, token, maxAge, "/", "", h.Cfg.CookieSecure, true)
+	_ = h.Store.SetLastLogin(ctx, userID, now.Format(time.RFC3339))
 
-	c.Status(http.StatusNoContent)
+	setSessionCookie(c, h.Cfg, token, expiresAt.Sub(now))
+	return nil
+}
+
+// GET /api/auth/config (public): which login methods the UI should offer
+func (h *AuthHandlers) AuthConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"passwordLogin": !h.Cfg.PasswordLoginDisabled,
+		"oidc":          h.Cfg.OIDCEnabled(),
+	})
 }
 
 func (h *AuthHandlers) Logout(c *gin.Context) {
-	token, err := c.Cookie(h.Cfg.CookieName)
-	if err == nil && strings.TrimSpace(token) != "" {
-		_, _ = h.DB.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	ctx := c.Request.Context()
+	if id := c.GetInt64(ginImpersonationKey); id != 0 {
+		if err := h.Store.EndImpersonation(ctx, id, nowRFC3339()); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+	}
+	if err := h.Store.DeleteSession(ctx, getSessionID(c)); err != nil {
+		internalError(c, "db error", err)
+		return
 	}
 
 	c.SetSameSite(http.SameSiteLaxMode)
@@ -120,24 +215,45 @@ func (h *AuthHandlers) Logout(c *gin.Context) {
 }
 
 func (h *AuthHandlers) Me(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID := getUserID(c)
 
-	var email string
-	var isAdmin int
-	err := h.DB.QueryRow(`SELECT email, is_admin FROM users WHERE id = ?`, userID).Scan(&email, &isAdmin)
+	u, err := h.Store.UserByID(ctx, userID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"userId":  userID,
-		"email":   email,
-		"isAdmin": isAdmin == 1,
-	})
+	perms, err := h.Store.UserPermissions(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	resp := gin.H{
+		"userId":      userID,
+		"email":       u.Email,
+		"displayName": u.DisplayName,
+		"isAdmin":     u.IsAdmin,
+		"permissions": perms,
+		"preferences": json.RawMessage(u.Preferences),
+		"csrfToken":   c.GetString(ginCSRFTokenKey),
+	}
+	if id := c.GetInt64(ginImpersonationKey); id != 0 {
+		imp, err := h.Store.Impersonation(ctx, id)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		resp["impersonator"] = gin.H{"userId": imp.AdminID, "email": imp.AdminEmail}
+		resp["impersonationExpiresAt"] = imp.ExpiresAt
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
 func (h *AuthHandlers) DeleteUserAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
 	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil || targetID <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
@@ -150,47 +266,42 @@ func (h *AuthHandlers) DeleteUserAdmin(c *gin.Context) {
 		return
 	}
 
-	tx, err := h.DB.Begin()
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		internalError(c, "db error", err)
 		return
 	}
-	defer tx.Rollback()
-
-	// delete share links for notes of this user
-	_, _ = tx.Exec(`
-		DELETE FROM share_links
-		WHERE note_id IN (SELECT id FROM notes WHERE user_id = ?)`,
-		targetID,
-	)
-
-	// delete notes
-	_, _ = tx.Exec(`DELETE FROM notes WHERE user_id = ?`, targetID)
-
-	// delete sessions (if any)
-	_, _ = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, targetID)
-
-	// delete user
-	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, targetID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	if ok, err := outranks(ctx, h.Store, actorPerms, targetID); err != nil || !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot delete this user"})
 		return
 	}
-	aff, _ := res.RowsAffected()
-	if aff == 0 {
+
+	target, err := h.Store.UserByID(ctx, targetID)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	found, err := h.Store.DeleteUser(ctx, targetID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
+	writeAudit(h.Store, c, getUserID(c), auditUserDelete, auditTarget("user", targetID), gin.H{"email": target.Email})
 
 	c.Status(http.StatusNoContent)
 }
 
 func (h *AuthHandlers) CreateUserAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req createUserReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
@@ -198,35 +309,45 @@ func (h *AuthHandlers) CreateUserAdmin(c *gin.Context) {
 	}
 
 	req.Email = strings.TrimSpace(strings.ToLower(req.Email))
-	if req.Email == "" || len(req.Password) < 6 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email required, password min 6"})
+	if req.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email required"})
+		return
+	}
+	if err := h.Passwords.Validate(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := h.Passwords.Hash(req.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "hash error"})
+		internalError(c, "hash error", err)
 		return
 	}
 
-	isAdmin := 0
 	if req.IsAdmin {
-		isAdmin = 1
+		perms, err := h.Store.UserPermissions(ctx, getUserID(c))
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if !hasPermission(perms, permAll) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only superusers can create admins"})
+			return
+		}
 	}
 
-	_, err = h.DB.Exec(
-		`INSERT INTO users(email, password_hash, is_admin, created_at) VALUES(?,?,?,?)`,
-		req.Email, string(hash), isAdmin, nowRFC3339(),
-	)
-	if err != nil {
+	u := User{Email: req.Email, IsAdmin: req.IsAdmin, CreatedAt: nowRFC3339()}
+	if err := h.Store.CreateUser(ctx, &u, hash); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "user exists or db error"})
 		return
 	}
+	writeAudit(h.Store, c, getUserID(c), auditUserCreate, auditTarget("user", u.ID), gin.H{"email": req.Email, "isAdmin": req.IsAdmin})
 
 	c.Status(http.StatusCreated)
 }
 
 func (h *AuthHandlers) SetAdminFlag(c *gin.Context) {
+	ctx := c.Request.Context()
 	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil || targetID <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
@@ -245,50 +366,79 @@ func (h *AuthHandlers) SetAdminFlag(c *gin.Context) {
 		return
 	}
 
-	val := 0
-	if req.IsAdmin {
-		val = 1
-	}
-
-	res, err := h.DB.Exec(`UPDATE users SET is_admin = ? WHERE id = ?`, val, targetID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	if _, err := h.Store.UserByID(ctx, targetID); errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		internalError(c, "db error", err)
 		return
 	}
-	aff, _ := res.RowsAffected()
-	if aff == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+
+	if err := h.Store.SetSuperuser(ctx, targetID, req.IsAdmin); err != nil {
+		internalError(c, "db error", err)
 		return
 	}
+	writeAudit(h.Store, c, getUserID(c), auditUserSetAdmin, auditTarget("user", targetID), gin.H{"isAdmin": req.IsAdmin})
 
 	c.Status(http.StatusNoContent)
 }
 
+// GET /api/admin/users?q=&sort=&order=&page=&pageSize=
+// The total number of matches is returned in the X-Total-Count header.
 func (h *AuthHandlers) ListUsersAdmin(c *gin.Context) {
-	rows, err := h.DB.Query(`SELECT id, email, is_admin, created_at FROM users ORDER BY id`)
+	ctx := c.Request.Context()
+	sort := c.DefaultQuery("sort", "id")
+	if _, ok := usersSortColumns[sort]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad sort"})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+
+	users, total, err := h.Store.ListUsers(ctx, UserQuery{
+		Search: strings.TrimSpace(c.Query("q")),
+		Sort:   sort,
+		Desc:   c.Query("order") == "desc",
+		Limit:  pageSize,
+		Offset: (page - 1) * pageSize,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		internalError(c, "db error", err)
 		return
 	}
-	defer rows.Close()
+	c.Header("X-Total-Count", strconv.Itoa(total))
 
 	type row struct {
-		ID        int64  `json:"id"`
-		Email     string `json:"email"`
-		IsAdmin   bool   `json:"isAdmin"`
-		CreatedAt string `json:"createdAt"`
-	}
-
-	out := []row{}
-	for rows.Next() {
-		var r row
-		var a int
-		if err := rows.Scan(&r.ID, &r.Email, &a, &r.CreatedAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-			return
-		}
-		r.IsAdmin = (a == 1)
-		out = append(out, r)
+		ID          int64    `json:"id"`
+		Email       string   `json:"email"`
+		IsAdmin     bool     `json:"isAdmin"`
+		Roles       []string `json:"roles"`
+		CreatedAt   string   `json:"createdAt"`
+		SuspendedAt string   `json:"suspendedAt,omitempty"`
+		DeleteAfter string   `json:"deleteAfter,omitempty"`
+		LastLoginAt string   `json:"lastLoginAt,omitempty"`
+		NoteCount   int      `json:"noteCount"`
+	}
+
+	out := make([]row, 0, len(users))
+	for _, u := range users {
+		out = append(out, row{
+			ID:          u.ID,
+			Email:       u.Email,
+			IsAdmin:     u.IsAdmin,
+			Roles:       u.Roles,
+			CreatedAt:   u.CreatedAt,
+			SuspendedAt: u.SuspendedAt,
+			DeleteAfter: u.DeleteAfter,
+			LastLoginAt: u.LastLoginAt,
+			NoteCount:   u.NoteCount,
+		})
 	}
 
 	c.JSON(http.StatusOK, out)
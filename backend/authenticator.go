@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	ErrUnknownUser = errors.New("unknown user")
+	ErrBadPassword = errors.New("bad password")
+)
+
+// Authenticator checks an email/password pair and returns the local user ID.
+// It returns ErrUnknownUser or ErrBadPassword for rejected credentials; any
+// other error means the backend itself failed.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, email, password string) (int64, error)
+}
+
+var authBackendNames = []string{"password", "ldap"}
+
+// newAuthenticators builds the chain named by cfg.AuthBackends, which
+// loadConfig has already checked against authBackendNames.
+func newAuthenticators(store Store, cfg Config, pw *Passwords) []Authenticator {
+	out := []Authenticator{}
+	for _, name := range cfg.AuthBackends {
+		switch name {
+		case "password":
+			out = append(out, &PasswordAuthenticator{Store: store, Passwords: pw})
+		case "ldap":
+			out = append(out, NewLDAPAuthenticator(store, cfg))
+		}
+	}
+	return out
+}
+
+// authenticate tries each backend in turn and returns the first match.
+// A rejection from every backend is reported as the most specific one seen.
+func authenticate(ctx context.Context, chain []Authenticator, email, password string) (int64, error) {
+	rejected := ErrUnknownUser
+	for _, a := range chain {
+		userID, err := a.Authenticate(ctx, email, password)
+		switch {
+		case err == nil:
+			return userID, nil
+		case errors.Is(err, ErrBadPassword):
+			rejected = ErrBadPassword
+		case errors.Is(err, ErrUnknownUser):
+		default:
+			return 0, fmt.Errorf("%s: %w", a.Name(), err)
+		}
+	}
+	return 0, rejected
+}
+
+// PasswordAuthenticator checks the hash stored in users.password_hash and
+// upgrades it to the current algorithm and parameters on success.
+type PasswordAuthenticator struct {
+	Store     Store
+	Passwords *Passwords
+}
+
+func (a *PasswordAuthenticator) Name() string { return "password" }
+
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, email, password string) (int64, error) {
+	userID, passHash, err := a.Store.PasswordHash(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		a.Passwords.VerifyDummy(password)
+		return 0, ErrUnknownUser
+	}
+	if err != nil {
+		return 0, err
+	}
+	// SSO and directory accounts have no hash, which would fail at once
+	if passHash == "" {
+		a.Passwords.VerifyDummy(password)
+		return 0, ErrBadPassword
+	}
+	if !a.Passwords.Verify(password, passHash) {
+		return 0, ErrBadPassword
+	}
+
+	if a.Passwords.NeedsRehash(passHash) {
+		if newHash, err := a.Passwords.Hash(password); err != nil {
+			slog.WarnContext(ctx, "password rehash failed", "user_id", userID, "error", err)
+		} else if err := a.Store.ReplacePasswordHash(ctx, userID, passHash, newHash); err != nil {
+			slog.WarnContext(ctx, "password rehash failed", "user_id", userID, "error", err)
+		}
+	}
+	return userID, nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backups are consistent snapshots of the SQLite database taken with
+// SQLite's online backup API while the server keeps running. They are
+// written to Config.BackupDir as greynote-<UTC timestamp>.db, optionally
+// gzipped.
+
+var errBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for PostgreSQL")
+
+var backupNameRe = regexp.MustCompile(`^greynote-\d{8}T\d{6}Z\.db(\.gz)?$`)
+
+type BackupInfo struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// snapshotSQLite copies db's main database into a new file at path. The copy
+// is made in a single backup step, so it holds a read lock on the source for
+// its duration; if a writer has the database locked the step is retried.
+func snapshotSQLite(ctx context.Context, db *sql.DB, path string) error {
+	if dialectOf(db) != dialectSQLite {
+		return errBackupUnsupported
+	}
+	src, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dstDB, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+	dst, err := dstDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return dst.Raw(func(dc any) error {
+		return src.Raw(func(sc any) error {
+			b, err := sqliteConn(dc).Backup("main", sqliteConn(sc), "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					return b.Finish()
+				}
+				// busy or locked: try again shortly
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
+
+// createBackup writes a new snapshot into dir. The file only appears under
+// its final name once it is complete.
+func createBackup(ctx context.Context, db *sql.DB, dir string, gz bool) (BackupInfo, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return BackupInfo{}, err
+	}
+	now := time.Now().UTC()
+	name := "greynote-" + now.Format("20060102T150405Z") + ".db"
+	if gz {
+		name += ".gz"
+	}
+	final := filepath.Join(dir, name)
+	if _, err := os.Stat(final); err == nil {
+		return BackupInfo{}, fmt.Errorf("backup %s already exists", name)
+	}
+
+	snap := filepath.Join(dir, "."+name+".partial")
+	defer os.Remove(snap)
+	if err := snapshotSQLite(ctx, db, snap); err != nil {
+		return BackupInfo{}, err
+	}
+	// backups contain password hashes and session tokens
+	if err := os.Chmod(snap, 0o600); err != nil {
+		return BackupInfo{}, err
+	}
+
+	out := snap
+	if gz {
+		out = snap + ".gz"
+		defer os.Remove(out)
+		if err := gzipFile(snap, out); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+	if err := os.Rename(out, final); err != nil {
+		return BackupInfo{}, err
+	}
+	st, err := os.Stat(final)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return BackupInfo{Name: name, Size: st.Size(), CreatedAt: now.Format(time.RFC3339)}, nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// listBackups returns the snapshots in dir, newest first. A missing
+// directory just means there are none yet.
+func listBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []BackupInfo{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !backupNameRe.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		ts, _ := time.Parse("20060102T150405Z", strings.TrimPrefix(strings.SplitN(e.Name(), ".", 2)[0], "greynote-"))
+		out = append(out, BackupInfo{Name: e.Name(), Size: info.Size(), CreatedAt: ts.Format(time.RFC3339)})
+	}
+	// the timestamp in the name sorts chronologically
+	slices.SortFunc(out, func(a, b BackupInfo) int { return strings.Compare(b.Name, a.Name) })
+	return out, nil
+}
+
+// pruneBackups deletes all but the newest keep snapshots in dir.
+func pruneBackups(dir string, keep int) (int64, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	all, err := listBackups(dir)
+	if err != nil || len(all) <= keep {
+		return 0, err
+	}
+	var n int64
+	for _, b := range all[keep:] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// errDatabaseLocked means a server has the SQLite database open.
+var errDatabaseLocked = errors.New("database is in use")
+
+// restoreSQLite replaces the database at dbPath with the snapshot at src
+// after checking that the snapshot is intact and not newer than this build.
+// The server must not be running: restore holds the lock servers share (see
+// lockSQLite) and an exclusive SQLite lock on the old database while it
+// swaps the files, and fails if it cannot get either. The replaced database
+// is kept next to it and its path returned.
+func restoreSQLite(src, dbPath string) (string, error) {
+	release, err := lockSQLite(dbPath, true)
+	if errors.Is(err, errDatabaseLocked) {
+		return "", fmt.Errorf("%s is in use: stop the server before restoring", dbPath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("lock %s: %w", dbPath, err)
+	}
+	defer release()
+
+	for _, suffix := range []string{"-journal", "-wal"} {
+		if _, err := os.Stat(dbPath + suffix); err == nil {
+			return "", fmt.Errorf("%s%s exists: stop the server before restoring", dbPath, suffix)
+		}
+	}
+
+	tmp := dbPath + ".restore-tmp"
+	defer os.Remove(tmp)
+	if err := copyBackupFile(src, tmp); err != nil {
+		return "", err
+	}
+	if err := checkSnapshot(tmp); err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		// other processes, such as admin commands, open the database
+		// without the lock file; wait briefly for any of them to finish
+		// writing and keep them out until the swap is done
+		old, err := sql.Open(sqliteDriverName, "file:"+dbPath+"?_busy_timeout=2000&_txlock=exclusive")
+		if err != nil {
+			return "", err
+		}
+		defer old.Close()
+		tx, err := old.Begin()
+		if err != nil {
+			return "", fmt.Errorf("%s is in use: %w", dbPath, err)
+		}
+		defer tx.Rollback()
+
+		previous = dbPath + ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(dbPath, previous); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		if previous != "" {
+			os.Rename(previous, dbPath)
+		}
+		return "", err
+	}
+	return previous, nil
+}
+
+// copyBackupFile copies src to dst, decompressing it if it is gzipped.
+func copyBackupFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var r io.Reader = in
+	if strings.HasSuffix(src, ".gz") {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkSnapshot opens the database file at path read-only and runs
+// checkDatabase on it.
+func checkSnapshot(path string) error {
+	db, err := sql.Open(sqliteDriverName, "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return checkDatabase(db)
+}
+
+// backupJob is the scheduled backup: one new snapshot, then retention.
+func backupJob(db *sql.DB, cfg Config) Job {
+	return Job{"backup", cfg.BackupEvery, func(ctx context.Context) error {
+		b, err := createBackup(ctx, db, cfg.BackupDir, cfg.BackupGzip)
+		if err != nil {
+			return err
+		}
+		slog.Info("backup written", "name", b.Name, "bytes", b.Size)
+		n, err := pruneBackups(cfg.BackupDir, cfg.BackupKeep)
+		if n > 0 {
+			slog.Info("old backups removed", "count", n)
+		}
+		return err
+	}}
+}
+
+type BackupHandlers struct {
+	DB    *sql.DB
+	Store Store
+	Cfg   Config
+}
+
+func NewBackupHandlers(db *sql.DB, store Store, cfg Config) *BackupHandlers {
+	return &BackupHandlers{DB: db, Store: store, Cfg: cfg}
+}
+
+// GET /api/admin/backups
+func (h *BackupHandlers) List(c *gin.Context) {
+	out, err := listBackups(h.Cfg.BackupDir)
+	if err != nil {
+		internalError(c, "could not list backups", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// POST /api/admin/backups
+// Takes a snapshot now and applies the retention setting.
+func (h *BackupHandlers) Create(c *gin.Context) {
+	b, err := createBackup(c.Request.Context(), h.DB, h.Cfg.BackupDir, h.Cfg.BackupGzip)
+	if err != nil {
+		internalError(c, "backup failed", err)
+		return
+	}
+	if _, err := pruneBackups(h.Cfg.BackupDir, h.Cfg.BackupKeep); err != nil {
+		requestLogger(c).Warn("prune backups", "error", err)
+	}
+	writeAudit(h.Store, c, getUserID(c), auditBackupCreate, "backup:"+b.Name, gin.H{"size": b.Size})
+	c.JSON(http.StatusCreated, b)
+}
+
+// GET /api/admin/backups/:name
+func (h *BackupHandlers) Download(c *gin.Context) {
+	name := c.Param("name")
+	if !backupNameRe.MatchString(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	path := filepath.Join(h.Cfg.BackupDir, name)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditBackupDownload, "backup:"+name, nil)
+	c.FileAttachment(path, name)
+}
+
+// runBackupCommand implements "greynote backup": take a snapshot of the
+// configured database while the server may keep running.
+func runBackupCommand(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", cfg.BackupDir, "directory to write the snapshot to")
+	gz := fs.Bool("gzip", cfg.BackupGzip, "gzip the snapshot")
+	keep := fs.Int("keep", cfg.BackupKeep, "delete all but this many newest snapshots afterwards (0 keeps all)")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: backup [-dir DIR] [-gzip] [-keep N]")
+	}
+	if cfg.DatabaseURL != "" {
+		return errBackupUnsupported
+	}
+	if cfg.Ephemeral {
+		return errors.New("an ephemeral database cannot be backed up from another process")
+	}
+
+	db, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	b, err := createBackup(context.Background(), db, *dir, *gz)
+	if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Join(*dir, b.Name))
+	n, err := pruneBackups(*dir, *keep)
+	if n > 0 {
+		fmt.Printf("removed %d old backups\n", n)
+	}
+	return err
+}
+
+// runRestoreCommand implements "greynote restore FILE". It replaces the
+// database at SQLITE_PATH and must be run while the server is stopped.
+func runRestoreCommand(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore FILE")
+	}
+	if cfg.DatabaseURL != "" || cfg.Ephemeral {
+		return errors.New("restore is only supported for a SQLite database file")
+	}
+	previous, err := restoreSQLite(fs.Arg(0), cfg.SQLitePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s into %s\n", fs.Arg(0), cfg.SQLitePath)
+	if previous != "" {
+		fmt.Printf("the previous database was moved to %s\n", previous)
+	}
+	return nil
+}
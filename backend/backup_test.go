@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreRefusesDatabaseInUse(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, map[string]string{"EPHEMERAL": "false", "SQLITE_PATH": filepath.Join(dir, "notes.db")})
+	db := openTestDB(t, cfg)
+	b, err := createBackup(context.Background(), db, filepath.Join(dir, "backups"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(dir, "backups", b.Name)
+
+	// a running server holds the lock file
+	release, err := lockSQLite(cfg.SQLitePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreSQLite(snapshot, cfg.SQLitePath); err == nil || !strings.Contains(err.Error(), "stop the server") {
+		t.Fatalf("restore under a running server: %v", err)
+	}
+	release()
+
+	// any other process in the middle of writing
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreSQLite(snapshot, cfg.SQLitePath); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("restore during a write: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	previous, err := restoreSQLite(snapshot, cfg.SQLitePath)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !strings.HasPrefix(previous, cfg.SQLitePath+".pre-restore-") {
+		t.Fatalf("previous database kept as %q", previous)
+	}
+
+	// and a server cannot start in the middle of a restore
+	release, err = lockSQLite(cfg.SQLitePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := lockSQLite(cfg.SQLitePath, false); err != errDatabaseLocked {
+		t.Fatalf("shared lock during a restore: %v", err)
+	}
+}
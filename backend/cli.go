@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The server binary doubles as an admin CLI. Every command works directly on
+// the configured database (SQLITE_PATH or DATABASE_URL), so it can be run
+// next to a live server, e.g. with "docker compose exec backend /app/greynote".
+// CLI changes are audited with actor 0 and "via": "cli" in the details.
+
+type command struct {
+	name  string
+	usage string
+	run   func(cfg Config, args []string) error
+}
+
+func cliCommands() []command {
+	return []command{
+		{"serve", "serve", runServe},
+		{"config", "config print", runConfigCommand},
+		{"migrate", "migrate up [version] | down [steps] | status", runMigrateCommand},
+		{"backup", "backup [-dir DIR] [-gzip] [-keep N]", runBackupCommand},
+		{"restore", "restore FILE", runRestoreCommand},
+		{"user", "user create|list|delete|set-admin|reset-password ...", runUserCommand},
+		{"session", "session purge [-user EMAIL|ID | -all]", runSessionCommand},
+		{"share", "share list [-all] | revoke TOKEN", runShareCommand},
+		{"db", "db check | vacuum", runDBCommand},
+	}
+}
+
+// runCommand parses the global flags in os.Args[1:], loads the
+// configuration and runs the command that follows them. Without a command
+// the binary serves, so "greynote" and "greynote -ephemeral" keep working.
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("greynote", flag.ExitOnError)
+	fs.Usage = func() {
+		printUsage(fs.Output())
+		fmt.Fprintln(fs.Output(), "\nflags (before the command; each also reads the env var it names):")
+		fs.PrintDefaults()
+	}
+	cf := registerConfigFlags(fs)
+	fs.Parse(args)
+	args = fs.Args()
+
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+		return nil
+	}
+	for _, c := range cliCommands() {
+		if c.name == name {
+			cfg, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			return c.run(cfg, args)
+		}
+	}
+	printUsage(os.Stderr)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: greynote [flags] [command]")
+	fmt.Fprintln(w, "commands (default: serve):")
+	for _, c := range cliCommands() {
+		fmt.Fprintln(w, "  "+c.usage)
+	}
+}
+
+// runSubcommand dispatches the second word of a command like "user create".
+func runSubcommand(cfg Config, args []string, usage string, subs map[string]func(Config, []string) error) error {
+	if len(args) > 0 {
+		if run, ok := subs[args[0]]; ok {
+			return run(cfg, args[1:])
+		}
+	}
+	return errors.New("usage: " + usage)
+}
+
+// openCLIDB opens the configured database with pending migrations applied,
+// as the server would on startup.
+func openCLIDB(cfg Config) (*sql.DB, error) {
+	if cfg.Ephemeral {
+		return nil, errors.New("admin commands need a persistent database; unset EPHEMERAL")
+	}
+	return openDB(cfg)
+}
+
+func runConfigCommand(cfg Config, args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+	return printConfig(os.Stdout, cfg)
+}
+
+// lookupUser finds a user by numeric ID or email.
+func lookupUser(db *sql.DB, ref string) (int64, string, error) {
+	var id int64
+	var email string
+	q, arg := `SELECT id, email FROM users WHERE email = ?`, any(strings.TrimSpace(strings.ToLower(ref)))
+	if n, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		q, arg = `SELECT id, email FROM users WHERE id = ?`, n
+	}
+	err := db.QueryRow(q, arg).Scan(&id, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", fmt.Errorf("no user %q", ref)
+	}
+	return id, email, err
+}
+
+// readPasswordLine reads one line from r, without the line break.
+func readPasswordLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func cliAudit(db *sql.DB, action, target string, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	details["via"] = "cli"
+	appendAudit(context.Background(), NewSQLStore(db), 0, "", action, target, details)
+}
+
+func runUserCommand(cfg Config, args []string) error {
+	return runSubcommand(cfg, args, "user create|list|delete|set-admin|reset-password ...", map[string]func(Config, []string) error{
+		"create":         runUserCreate,
+		"list":           runUserList,
+		"delete":         runUserDelete,
+		"set-admin":      runUserSetAdmin,
+		"reset-password": runUserResetPassword,
+	})
+}
+
+func runUserCreate(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ExitOnError)
+	admin := fs.Bool("admin", false, "grant the superuser role")
+	fromStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: user create [-admin] [-password-stdin] EMAIL")
+	}
+	email := strings.TrimSpace(strings.ToLower(fs.Arg(0)))
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%q is not a valid email", fs.Arg(0))
+	}
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pw, err := NewPasswords(cfg)
+	if err != nil {
+		return err
+	}
+
+	var password string
+	if *fromStdin {
+		if password, err = readPasswordLine(os.Stdin); err != nil {
+			return err
+		}
+	} else if password, err = randomTokenURLSafe(18); err != nil {
+		return err
+	}
+	if err := pw.Validate(password); err != nil {
+		return err
+	}
+	hash, err := pw.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, email).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return fmt.Errorf("user %s already exists", email)
+	}
+	var id int64
+	err = tx.QueryRow(
+		`INSERT INTO users(email, password_hash, created_at) VALUES(?,?,?) RETURNING id`,
+		email, hash, nowRFC3339(),
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if *admin {
+		if err := setSuperuser(context.Background(), tx, id, true); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	cliAudit(db, auditUserCreate, auditTarget("user", id), gin.H{"email": email, "isAdmin": *admin})
+
+	fmt.Printf("created user %d (%s)\n", id, email)
+	if !*fromStdin {
+		fmt.Printf("password: %s\n", password)
+	}
+	return nil
+}
+
+func runUserList(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	q := fs.String("q", "", "only users whose email contains this")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: user list [-q TEXT]")
+	}
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(
+		`SELECT id, email, is_admin, created_at, last_login_at, suspended_at, delete_after
+		FROM users WHERE LOWER(email) LIKE LOWER(?) ESCAPE '\' ORDER BY id`,
+		"%"+escapeLike(*q)+"%",
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tADMIN\tCREATED\tLAST LOGIN\tSTATUS")
+	for rows.Next() {
+		var id int64
+		var isAdmin bool
+		var email, created, lastLogin, suspended, deleteAfter string
+		if err := rows.Scan(&id, &email, &isAdmin, &created, &lastLogin, &suspended, &deleteAfter); err != nil {
+			return err
+		}
+		status := "active"
+		switch {
+		case deleteAfter != "":
+			status = "deletion scheduled " + deleteAfter
+		case suspended != "":
+			status = "suspended"
+		}
+		admin := ""
+		if isAdmin {
+			admin = "yes"
+		}
+		if lastLogin == "" {
+			lastLogin = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", id, email, admin, created, lastLogin, status)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func runUserDelete(cfg Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: user delete EMAIL|ID")
+	}
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, email, err := lookupUser(db, args[0])
+	if err != nil {
+		return err
+	}
+	if err := checkNotLastSuperuser(db, id); err != nil {
+		return err
+	}
+	if _, err := NewSQLStore(db).DeleteUser(context.Background(), id); err != nil {
+		return err
+	}
+	cliAudit(db, auditUserDelete, auditTarget("user", id), gin.H{"email": email})
+	fmt.Printf("deleted user %d (%s)\n", id, email)
+	return nil
+}
+
+// checkNotLastSuperuser refuses changes that would leave nobody able to
+// administer the instance.
+func checkNotLastSuperuser(db *sql.DB, userID int64) error {
+	var others int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE r.name = ? AND ur.user_id != ?`,
+		roleSuperuser, userID,
+	).Scan(&others)
+	if err != nil {
+		return err
+	}
+	var isSuper int
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE r.name = ? AND ur.user_id = ?`,
+		roleSuperuser, userID,
+	).Scan(&isSuper)
+	if err != nil {
+		return err
+	}
+	if isSuper > 0 && others == 0 {
+		return errors.New("this is the last superuser")
+	}
+	return nil
+}
+
+func runUserSetAdmin(cfg Config, args []string) error {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return errors.New("usage: user set-admin EMAIL|ID on|off")
+	}
+	on := args[1] == "on"
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, email, err := lookupUser(db, args[0])
+	if err != nil {
+		return err
+	}
+	if !on {
+		if err := checkNotLastSuperuser(db, id); err != nil {
+			return err
+		}
+	}
+	if err := setSuperuser(context.Background(), db, id, on); err != nil {
+		return err
+	}
+	cliAudit(db, auditUserSetAdmin, auditTarget("user", id), gin.H{"isAdmin": on})
+	fmt.Printf("%s: superuser %s\n", email, args[1])
+	return nil
+}
+
+// runUserResetPassword prints a set-password link, or with -password-stdin
+// sets the password directly. Either way the user's sessions end when the
+// new password is set.
+func runUserResetPassword(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("user reset-password", flag.ExitOnError)
+	fromStdin := fs.Bool("password-stdin", false, "set the password read from stdin instead of issuing a link")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: user reset-password [-password-stdin] EMAIL|ID")
+	}
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, email, err := lookupUser(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if !*fromStdin {
+		token, expiresAt, err := issuePasswordReset(context.Background(), NewSQLStore(db), id, 0, cfg.PasswordResetTTL)
+		if err != nil {
+			return err
+		}
+		cliAudit(db, auditPasswordResetIssue, auditTarget("user", id), gin.H{"expiresAt": expiresAt})
+		fmt.Printf("set-password link for %s (valid until %s):\n", email, expiresAt)
+		fmt.Println(strings.TrimRight(cfg.FrontendOrigin, "/") + "/reset-password/" + token)
+		return nil
+	}
+
+	password, err := readPasswordLine(os.Stdin)
+	if err != nil {
+		return err
+	}
+	pw, err := NewPasswords(cfg)
+	if err != nil {
+		return err
+	}
+	if err := pw.Validate(password); err != nil {
+		return err
+	}
+	hash, err := pw.Hash(password)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, hash, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	cliAudit(db, auditPasswordResetFinish, auditTarget("user", id), nil)
+	fmt.Printf("password set for %s; their sessions were ended\n", email)
+	return nil
+}
+
+func runSessionCommand(cfg Config, args []string) error {
+	return runSubcommand(cfg, args, "session purge [-user EMAIL|ID | -all]", map[string]func(Config, []string) error{
+		"purge": runSessionPurge,
+	})
+}
+
+// runSessionPurge removes expired sessions, or all sessions of one user or
+// of everybody.
+func runSessionPurge(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("session purge", flag.ExitOnError)
+	user := fs.String("user", "", "end all sessions of this user")
+	all := fs.Bool("all", false, "end every session, signing everybody out")
+	fs.Parse(args)
+	if fs.NArg() > 0 || (*user != "" && *all) {
+		return errors.New("usage: session purge [-user EMAIL|ID | -all]")
+	}
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var n int64
+	switch {
+	case *all:
+		res, err := db.Exec(`DELETE FROM sessions`)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		cliAudit(db, auditSessionRevoke, "", gin.H{"revoked": n, "all": true})
+	case *user != "":
+		id, _, err := lookupUser(db, *user)
+		if err != nil {
+			return err
+		}
+		res, err := db.Exec(`DELETE FROM sessions WHERE user_id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		cliAudit(db, auditSessionRevoke, auditTarget("user", id), gin.H{"revoked": n})
+	default:
+		if n, err = NewSQLStore(db).PurgeExpiredSessions(context.Background(), nowRFC3339()); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("removed %d sessions\n", n)
+	return nil
+}
+
+func runShareCommand(cfg Config, args []string) error {
+	return runSubcommand(cfg, args, "share list [-all] | revoke TOKEN", map[string]func(Config, []string) error{
+		"list":   runShareList,
+		"revoke": runShareRevoke,
+	})
+}
+
+func runShareList(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("share list", flag.ExitOnError)
+	all := fs.Bool("all", false, "include disabled links")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: share list [-all]")
+	}
+
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	where := ` WHERE s.is_enabled = 1`
+	if *all {
+		where = ``
+	}
+	rows, err := db.Query(
+		`SELECT s.token, s.is_enabled, s.created_at, n.id, n.title, u.email
+		FROM share_links s JOIN notes n ON n.id = s.note_id JOIN users u ON u.id = n.user_id` + where + `
+		ORDER BY s.created_at, s.id`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tENABLED\tCREATED\tNOTE\tOWNER\tTITLE")
+	for rows.Next() {
+		var token, created, title, owner string
+		var enabled bool
+		var noteID int64
+		if err := rows.Scan(&token, &enabled, &created, &noteID, &title, &owner); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%d\t%s\t%s\n", token, enabled, created, noteID, owner, title)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func runShareRevoke(cfg Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: share revoke TOKEN")
+	}
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var noteID int64
+	if err := db.QueryRow(`SELECT note_id FROM share_links WHERE token = ?`, args[0]).Scan(&noteID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no such share link")
+		}
+		return err
+	}
+	if err := NewSQLStore(db).DisableShareLink(context.Background(), noteID); err != nil {
+		return err
+	}
+	cliAudit(db, auditShareDisable, auditTarget("note", noteID), nil)
+	fmt.Printf("disabled the share link of note %d\n", noteID)
+	return nil
+}
+
+func runDBCommand(cfg Config, args []string) error {
+	return runSubcommand(cfg, args, "db check | vacuum", map[string]func(Config, []string) error{
+		"check":  runDBCheck,
+		"vacuum": runDBVacuum,
+	})
+}
+
+// runDBCheck verifies the database without changing it: no migrations are
+// applied, pending ones are only reported.
+func runDBCheck(cfg Config, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: db check")
+	}
+	db, err := connectExistingDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok\n", cfg.databaseLabel())
+	return printMigrationStatus(db, os.Stdout)
+}
+
+func runDBVacuum(cfg Config, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: db vacuum")
+	}
+	db, err := openCLIDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	q := `VACUUM`
+	if dialectOf(db) == dialectPostgres {
+		q = `VACUUM ANALYZE`
+	}
+	if _, err := db.Exec(q); err != nil {
+		return err
+	}
+	fmt.Println("done")
+	return nil
+}
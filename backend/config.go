@@ -0,0 +1,674 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Addr       string
+	SQLitePath string
+
+	// HTTP server timeouts. ShutdownTimeout bounds how long a stopping
+	// server waits for in-flight requests and background jobs.
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+	ShutdownTimeout  time.Duration
+
+	// LogLevel is the least severe level written; LogFormat is "json" or
+	// "text".
+	LogLevel  slog.Level
+	LogFormat string
+
+	// MetricsEnabled serves Prometheus metrics on /metrics, on MetricsAddr
+	// if set and on Addr otherwise. MetricsToken, if set, must be presented
+	// as a bearer token; on Addr it is required.
+	MetricsEnabled bool
+	MetricsAddr    string
+	MetricsToken   string
+
+	// TracingExporter is where OpenTelemetry spans go: "none", "otlp" (to
+	// TracingOTLPEndpoint over HTTP) or "stdout". TracingSampleRatio is the
+	// share of new traces that are recorded.
+	TracingExporter     string
+	TracingOTLPEndpoint string
+	TracingSampleRatio  float64
+
+	// DatabaseURL, when set, is a postgres:// DSN used instead of SQLite.
+	DatabaseURL string
+	// Ephemeral keeps all data in an in-memory database that is discarded
+	// when the process exits.
+	Ephemeral      bool
+	FrontendOrigin string
+
+	CookieName   string
+	CookieSecure bool
+
+	// CSRFTrustedOrigins are accepted as Origin on mutating requests in
+	// addition to FrontendOrigin and the backend's own host.
+	CSRFTrustedOrigins []string
+
+	// TrustedProxies are the addresses and CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed. With none, the client IP
+	// used for throttling and the audit log is the connection's peer.
+	TrustedProxies []string
+
+	// SessionTTL is the idle timeout: sessions unused for this long expire.
+	// SessionAbsoluteTTL caps a session's lifetime regardless of activity.
+	SessionTTL         time.Duration
+	SessionAbsoluteTTL time.Duration
+	SessionSweepEvery  time.Duration
+
+	// AccountDeletionGrace is how long a scheduled deletion waits.
+	AccountDeletionGrace time.Duration
+	// PasswordResetTTL is how long an admin-issued set-password link works.
+	PasswordResetTTL time.Duration
+	// ImpersonationTTL is how long an admin's "act as user" session lasts.
+	ImpersonationTTL time.Duration
+	// WorkspaceInviteTTL is how long a workspace invitation link works.
+	WorkspaceInviteTTL time.Duration
+
+	// LoginMaxFailures and LoginMaxFailuresPerIP are the failed logins allowed
+	// before an account or client IP is locked out. Each further failure
+	// doubles the lockout, starting at LoginLockoutBase up to LoginLockoutMax.
+	LoginMaxFailures      int
+	LoginMaxFailuresPerIP int
+	LoginLockoutBase      time.Duration
+	LoginLockoutMax       time.Duration
+	// LoginAttemptRetention is how long failed login attempts are kept.
+	LoginAttemptRetention time.Duration
+
+	// PasswordHash is the algorithm for new hashes: "argon2id" or "bcrypt".
+	// Existing hashes in the other format are upgraded on the next login.
+	PasswordHash    string
+	Argon2Time      uint32
+	Argon2MemoryKiB uint32
+	Argon2Threads   uint8
+	BcryptCost      int
+
+	PasswordMinLength    int
+	PasswordMaxLength    int
+	PasswordBreachedList string
+
+	// AuthBackends is the ordered chain of password checkers used by Login.
+	AuthBackends []string
+
+	LDAPURL          string
+	LDAPStartTLS     bool
+	LDAPBindDN       string
+	LDAPBindPassword string
+	LDAPBaseDN       string
+	LDAPUserFilter   string
+	LDAPGroupAttr    string
+	LDAPAdminGroup   string
+
+	// OIDC single sign-on is enabled when OIDCIssuer is set.
+	OIDCIssuer            string
+	OIDCClientID          string
+	OIDCClientSecret      string
+	OIDCRedirectURL       string
+	OIDCScopes            []string
+	OIDCGroupsClaim       string
+	OIDCAdminGroup        string
+	PasswordLoginDisabled bool
+
+	// BackupDir holds SQLite snapshots. BackupEvery > 0 takes one on that
+	// schedule; BackupKeep is how many are retained (0 keeps all).
+	BackupDir   string
+	BackupEvery time.Duration
+	BackupKeep  int
+	BackupGzip  bool
+
+	AdminEmail    string
+	AdminPassword string
+
+	// sources records where each setting came from, keyed by env name.
+	sources map[string]settingSource
+}
+
+func (c Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != ""
+}
+
+// Settings come from, in order of precedence: command-line flags, environment
+// variables, the config file and built-in defaults. Every setting has one
+// name in each: SESSION_TTL_HOURS is -session-ttl-hours on the command line
+// and session_ttl_hours in the file. Invalid values fail startup instead of
+// falling back to the default.
+
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindList
+)
+
+type setting struct {
+	key    string // environment variable
+	def    string
+	kind   settingKind
+	secret bool
+	help   string
+	apply  func(c *Config, v string) error
+}
+
+func (s setting) flagName() string { return strings.ReplaceAll(strings.ToLower(s.key), "_", "-") }
+func (s setting) fileKey() string  { return strings.ToLower(s.key) }
+
+// Value parsers used by the settings table.
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean (use true/false or 1/0)", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func parseIntIn(v string, min, max int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", v)
+	}
+	if n < min {
+		return 0, fmt.Errorf("must be at least %d, got %d", min, n)
+	}
+	if n > max {
+		return 0, fmt.Errorf("must be at most %d, got %d", max, n)
+	}
+	return n, nil
+}
+
+func setInt(min, max int, field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := parseIntIn(v, min, max)
+		if err == nil {
+			*field(c) = n
+		}
+		return err
+	}
+}
+
+// setDuration reads a whole number of units, as in SESSION_TTL_HOURS.
+func setDuration(unit time.Duration, min int, field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := parseIntIn(v, min, math.MaxInt32)
+		if err == nil {
+			*field(c) = time.Duration(n) * unit
+		}
+		return err
+	}
+}
+
+// splitList accepts commas and/or whitespace between items.
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+func setList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = splitList(v)
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"ADDR", ":8080", kindString, false, "listen address", setString(func(c *Config) *string { return &c.Addr })},
+	{"HTTP_READ_TIMEOUT_SECONDS", "30", kindInt, false, "limit for reading a request, body included", setDuration(time.Second, 1, func(c *Config) *time.Duration { return &c.HTTPReadTimeout })},
+	{"HTTP_WRITE_TIMEOUT_SECONDS", "120", kindInt, false, "limit for writing a response, downloads included", setDuration(time.Second, 1, func(c *Config) *time.Duration { return &c.HTTPWriteTimeout })},
+	{"HTTP_IDLE_TIMEOUT_SECONDS", "120", kindInt, false, "how long idle keep-alive connections stay open", setDuration(time.Second, 1, func(c *Config) *time.Duration { return &c.HTTPIdleTimeout })},
+	{"SHUTDOWN_TIMEOUT_SECONDS", "20", kindInt, false, "grace period for requests and jobs on SIGTERM", setDuration(time.Second, 1, func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"LOG_LEVEL", "info", kindString, false, "least severe log level written: debug, info, warn, error", func(c *Config, v string) error {
+		if err := c.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("must be debug, info, warn or error, got %q", v)
+		}
+		return nil
+	}},
+	{"LOG_FORMAT", "json", kindString, false, "server log format: json or text", func(c *Config, v string) error {
+		if v != "json" && v != "text" {
+			return fmt.Errorf("must be json or text, got %q", v)
+		}
+		c.LogFormat = v
+		return nil
+	}},
+	{"METRICS_ENABLED", "false", kindBool, false, "serve Prometheus metrics on /metrics", setBool(func(c *Config) *bool { return &c.MetricsEnabled })},
+	{"METRICS_ADDR", "", kindString, false, "separate listen address for /metrics; empty serves it on ADDR, which requires METRICS_TOKEN", setString(func(c *Config) *string { return &c.MetricsAddr })},
+	{"METRICS_TOKEN", "", kindString, true, "bearer token scrapers must send for /metrics", setString(func(c *Config) *string { return &c.MetricsToken })},
+	{"TRACING_EXPORTER", "none", kindString, false, "OpenTelemetry span exporter: none, otlp or stdout", func(c *Config, v string) error {
+		if v != "none" && v != "otlp" && v != "stdout" {
+			return fmt.Errorf("must be none, otlp or stdout, got %q", v)
+		}
+		c.TracingExporter = v
+		return nil
+	}},
+	{"TRACING_OTLP_ENDPOINT", "http://localhost:4318", kindString, false, "OTLP/HTTP collector URL; /v1/traces is used when it has no path", func(c *Config, v string) error {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("must be an http:// or https:// URL, got %q", v)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		c.TracingOTLPEndpoint = u.String()
+		return nil
+	}},
+	{"TRACING_SAMPLE_RATIO", "1", kindFloat, false, "share of new traces recorded, 0 to 1; incoming sampled traces are always followed", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("must be a number from 0 to 1, got %q", v)
+		}
+		c.TracingSampleRatio = f
+		return nil
+	}},
+	{"SQLITE_PATH", "./notes.db", kindString, false, "SQLite database file", setString(func(c *Config) *string { return &c.SQLitePath })},
+	{"DATABASE_URL", "", kindString, true, "postgres:// URL; use PostgreSQL instead of SQLite", func(c *Config, v string) error {
+		if v != "" && !isPostgresURL(v) {
+			return errors.New("must be a postgres:// or postgresql:// URL")
+		}
+		c.DatabaseURL = v
+		return nil
+	}},
+	{"EPHEMERAL", "false", kindBool, false, "keep all data in memory and start empty on every restart", setBool(func(c *Config) *bool { return &c.Ephemeral })},
+	{"FRONTEND_ORIGIN", "http://localhost:5173", kindString, false, "origin of the web frontend (CORS, links)", setString(func(c *Config) *string { return &c.FrontendOrigin })},
+
+	{"COOKIE_NAME", "notes_session", kindString, false, "session cookie name", func(c *Config, v string) error {
+		if v == "" {
+			return errors.New("must not be empty")
+		}
+		c.CookieName = v
+		return nil
+	}},
+	{"COOKIE_SECURE", "false", kindBool, false, "mark the session cookie Secure (HTTPS only)", setBool(func(c *Config) *bool { return &c.CookieSecure })},
+	{"CSRF_TRUSTED_ORIGINS", "", kindList, false, "extra origins allowed on mutating requests", func(c *Config, v string) error {
+		c.CSRFTrustedOrigins = []string{}
+		for _, o := range splitList(v) {
+			c.CSRFTrustedOrigins = append(c.CSRFTrustedOrigins, strings.TrimRight(o, "/"))
+		}
+		return nil
+	}},
+	{"TRUSTED_PROXIES", "", kindList, false, "reverse proxies (IPs or CIDRs) whose X-Forwarded-For is trusted", func(c *Config, v string) error {
+		c.TrustedProxies = []string{}
+		for _, p := range splitList(v) {
+			if net.ParseIP(p) == nil {
+				if _, _, err := net.ParseCIDR(p); err != nil {
+					return fmt.Errorf("%q is neither an IP address nor a CIDR range", p)
+				}
+			}
+			c.TrustedProxies = append(c.TrustedProxies, p)
+		}
+		return nil
+	}},
+
+	{"SESSION_TTL_HOURS", "168", kindInt, false, "idle session timeout", setDuration(time.Hour, 1, func(c *Config) *time.Duration { return &c.SessionTTL })},
+	{"SESSION_ABSOLUTE_TTL_HOURS", "720", kindInt, false, "maximum session lifetime", setDuration(time.Hour, 1, func(c *Config) *time.Duration { return &c.SessionAbsoluteTTL })},
+	{"SESSION_SWEEP_MINUTES", "15", kindInt, false, "how often expired data is purged", setDuration(time.Minute, 1, func(c *Config) *time.Duration { return &c.SessionSweepEvery })},
+	{"ACCOUNT_DELETION_GRACE_DAYS", "30", kindInt, false, "delay before a scheduled account deletion", setDuration(24*time.Hour, 0, func(c *Config) *time.Duration { return &c.AccountDeletionGrace })},
+	{"PASSWORD_RESET_TTL_HOURS", "24", kindInt, false, "validity of set-password links", setDuration(time.Hour, 1, func(c *Config) *time.Duration { return &c.PasswordResetTTL })},
+	{"IMPERSONATION_TTL_MINUTES", "30", kindInt, false, "length of an admin's act-as-user session", setDuration(time.Minute, 1, func(c *Config) *time.Duration { return &c.ImpersonationTTL })},
+	{"WORKSPACE_INVITE_TTL_HOURS", "168", kindInt, false, "validity of workspace invitations", setDuration(time.Hour, 1, func(c *Config) *time.Duration { return &c.WorkspaceInviteTTL })},
+
+	{"LOGIN_MAX_FAILURES", "5", kindInt, false, "failed logins before an account is locked", setInt(1, math.MaxInt32, func(c *Config) *int { return &c.LoginMaxFailures })},
+	{"LOGIN_MAX_FAILURES_PER_IP", "20", kindInt, false, "failed logins before a client IP is locked", setInt(1, math.MaxInt32, func(c *Config) *int { return &c.LoginMaxFailuresPerIP })},
+	{"LOGIN_LOCKOUT_BASE_SECONDS", "30", kindInt, false, "first lockout; doubles with each further failure", setDuration(time.Second, 1, func(c *Config) *time.Duration { return &c.LoginLockoutBase })},
+	{"LOGIN_LOCKOUT_MAX_MINUTES", "60", kindInt, false, "longest lockout", setDuration(time.Minute, 1, func(c *Config) *time.Duration { return &c.LoginLockoutMax })},
+	{"LOGIN_ATTEMPT_RETENTION_DAYS", "30", kindInt, false, "how long failed login attempts are kept", setDuration(24*time.Hour, 1, func(c *Config) *time.Duration { return &c.LoginAttemptRetention })},
+
+	{"PASSWORD_HASH", passwordAlgoArgon2id, kindString, false, "hash for new passwords: argon2id or bcrypt", func(c *Config, v string) error {
+		if v != passwordAlgoArgon2id && v != passwordAlgoBcrypt {
+			return fmt.Errorf("must be %s or %s, got %q", passwordAlgoArgon2id, passwordAlgoBcrypt, v)
+		}
+		c.PasswordHash = v
+		return nil
+	}},
+	{"ARGON2_TIME", "3", kindInt, false, "argon2id iterations", func(c *Config, v string) error {
+		n, err := parseIntIn(v, 1, math.MaxInt32)
+		c.Argon2Time = uint32(n)
+		return err
+	}},
+	{"ARGON2_MEMORY_KIB", "65536", kindInt, false, "argon2id memory in KiB", func(c *Config, v string) error {
+		n, err := parseIntIn(v, 8, math.MaxInt32)
+		c.Argon2MemoryKiB = uint32(n)
+		return err
+	}},
+	{"ARGON2_THREADS", "2", kindInt, false, "argon2id parallelism", func(c *Config, v string) error {
+		n, err := parseIntIn(v, 1, math.MaxUint8)
+		c.Argon2Threads = uint8(n)
+		return err
+	}},
+	{"BCRYPT_COST", strconv.Itoa(bcrypt.DefaultCost), kindInt, false, "bcrypt cost", setInt(bcrypt.MinCost, bcrypt.MaxCost, func(c *Config) *int { return &c.BcryptCost })},
+	{"PASSWORD_MIN_LENGTH", "8", kindInt, false, "shortest accepted password", setInt(1, math.MaxInt32, func(c *Config) *int { return &c.PasswordMinLength })},
+	{"PASSWORD_MAX_LENGTH", "128", kindInt, false, "longest accepted password", setInt(1, math.MaxInt32, func(c *Config) *int { return &c.PasswordMaxLength })},
+	{"PASSWORD_BREACHED_LIST", "", kindString, false, "file of SHA-1 hashes of passwords to reject", setString(func(c *Config) *string { return &c.PasswordBreachedList })},
+
+	// the default depends on LDAP_URL, see loadConfig
+	{"AUTH_BACKENDS", "password", kindList, false, "password checkers, in order: password, ldap", func(c *Config, v string) error {
+		c.AuthBackends = []string{}
+		for _, name := range splitList(v) {
+			if !slices.Contains(authBackendNames, name) {
+				return fmt.Errorf("unknown backend %q (known: %s)", name, strings.Join(authBackendNames, ", "))
+			}
+			c.AuthBackends = append(c.AuthBackends, name)
+		}
+		return nil
+	}},
+
+	{"LDAP_URL", "", kindString, false, "LDAP server, e.g. ldaps://ldap.example.com", setString(func(c *Config) *string { return &c.LDAPURL })},
+	{"LDAP_START_TLS", "false", kindBool, false, "upgrade ldap:// connections with StartTLS", setBool(func(c *Config) *bool { return &c.LDAPStartTLS })},
+	{"LDAP_BIND_DN", "", kindString, false, "service account for user lookups", setString(func(c *Config) *string { return &c.LDAPBindDN })},
+	{"LDAP_BIND_PASSWORD", "", kindString, true, "service account password", setString(func(c *Config) *string { return &c.LDAPBindPassword })},
+	{"LDAP_BASE_DN", "", kindString, false, "where to search for users", setString(func(c *Config) *string { return &c.LDAPBaseDN })},
+	{"LDAP_USER_FILTER", "(mail=%s)", kindString, false, "user search filter; %s is the escaped email", setString(func(c *Config) *string { return &c.LDAPUserFilter })},
+	{"LDAP_GROUP_ATTR", "memberOf", kindString, false, "attribute listing a user's groups", setString(func(c *Config) *string { return &c.LDAPGroupAttr })},
+	{"LDAP_ADMIN_GROUP", "", kindString, false, "members of this group become admins", setString(func(c *Config) *string { return &c.LDAPAdminGroup })},
+
+	{"OIDC_ISSUER", "", kindString, false, "OpenID Connect issuer; enables single sign-on", setString(func(c *Config) *string { return &c.OIDCIssuer })},
+	{"OIDC_CLIENT_ID", "", kindString, false, "OIDC client ID", setString(func(c *Config) *string { return &c.OIDCClientID })},
+	{"OIDC_CLIENT_SECRET", "", kindString, true, "OIDC client secret", setString(func(c *Config) *string { return &c.OIDCClientSecret })},
+	{"OIDC_REDIRECT_URL", "", kindString, false, "OIDC callback URL", setString(func(c *Config) *string { return &c.OIDCRedirectURL })},
+	{"OIDC_SCOPES", "openid email profile", kindList, false, "OIDC scopes", setList(func(c *Config) *[]string { return &c.OIDCScopes })},
+	{"OIDC_GROUPS_CLAIM", "groups", kindString, false, "ID token claim listing groups", setString(func(c *Config) *string { return &c.OIDCGroupsClaim })},
+	{"OIDC_ADMIN_GROUP", "", kindString, false, "members of this group become admins", setString(func(c *Config) *string { return &c.OIDCAdminGroup })},
+	{"PASSWORD_LOGIN_DISABLED", "false", kindBool, false, "allow single sign-on only", setBool(func(c *Config) *bool { return &c.PasswordLoginDisabled })},
+
+	{"BACKUP_DIR", "./backups", kindString, false, "where SQLite snapshots are written", setString(func(c *Config) *string { return &c.BackupDir })},
+	{"BACKUP_INTERVAL_HOURS", "0", kindInt, false, "take a snapshot this often; 0 disables", setDuration(time.Hour, 0, func(c *Config) *time.Duration { return &c.BackupEvery })},
+	{"BACKUP_KEEP", "7", kindInt, false, "snapshots to keep; 0 keeps all", setInt(0, math.MaxInt32, func(c *Config) *int { return &c.BackupKeep })},
+	{"BACKUP_GZIP", "true", kindBool, false, "gzip snapshots", setBool(func(c *Config) *bool { return &c.BackupGzip })},
+
+	{"ADMIN_EMAIL", "", kindString, false, "make sure this superuser exists on startup", setString(func(c *Config) *string { return &c.AdminEmail })},
+	{"ADMIN_PASSWORD", "", kindString, true, "initial password for ADMIN_EMAIL", setString(func(c *Config) *string { return &c.AdminPassword })},
+}
+
+// A settingSource says where a setting's effective value came from.
+type settingSource struct {
+	kind  string // "flag", "env", "file" or "default"
+	file  string
+	value string
+}
+
+func (src settingSource) describe(s setting) string {
+	switch src.kind {
+	case "flag":
+		return "-" + s.flagName()
+	case "env":
+		return s.key
+	case "file":
+		return s.fileKey() + " in " + src.file
+	default:
+		return s.key + " (default)"
+	}
+}
+
+// configFlags holds the command-line flags shared by all commands.
+type configFlags struct {
+	file   string
+	values map[string]*settingFlag
+}
+
+// settingFlag is a flag.Value that remembers whether it was given.
+type settingFlag struct {
+	kind  settingKind
+	value string
+	set   bool
+}
+
+func (f *settingFlag) String() string { return f.value }
+func (f *settingFlag) Set(v string) error {
+	f.value, f.set = v, true
+	return nil
+}
+func (f *settingFlag) IsBoolFlag() bool { return f.kind == kindBool }
+
+// registerConfigFlags adds -config and one flag per setting to fs.
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{values: map[string]*settingFlag{}}
+	fs.StringVar(&cf.file, "config", "", "YAML (.yaml, .yml) or TOML (.toml) config file (env: CONFIG_FILE)")
+	for _, s := range settings {
+		f := &settingFlag{kind: s.kind}
+		cf.values[s.key] = f
+		usage := s.help + " (env: " + s.key + ", default: " + strconv.Quote(s.def) + ")"
+		fs.Var(f, s.flagName(), usage)
+	}
+	return cf
+}
+
+// readConfigFile reads a flat YAML or TOML file of settings into strings.
+// Lists may be written as sequences or as comma-separated strings.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file type (use .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	known := map[string]setting{}
+	for _, s := range settings {
+		known[s.fileKey()] = s
+	}
+	out := map[string]string{}
+	var problems []string
+	for k, v := range raw {
+		s, ok := known[k]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s in %s: unknown setting", k, path))
+			continue
+		}
+		switch v := v.(type) {
+		case []any:
+			if s.kind != kindList {
+				problems = append(problems, fmt.Sprintf("%s in %s: a list is not allowed here", k, path))
+				continue
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[k] = strings.Join(items, ",")
+		case map[string]any:
+			problems = append(problems, fmt.Sprintf("%s in %s: nested tables are not allowed", k, path))
+		case nil:
+			out[k] = ""
+		default:
+			out[k] = fmt.Sprint(v)
+		}
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return nil, errors.New(strings.Join(problems, "\n  "))
+	}
+	return out, nil
+}
+
+// loadConfig resolves every setting and validates the result, reporting all
+// problems at once.
+func loadConfig(cf *configFlags) (Config, error) {
+	path := cf.file
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	fileValues := map[string]string{}
+	if path != "" {
+		var err error
+		if fileValues, err = readConfigFile(path); err != nil {
+			return Config{}, fmt.Errorf("invalid configuration:\n  %w", err)
+		}
+	}
+
+	var cfg Config
+	sources := map[string]settingSource{}
+	var problems []string
+	for _, s := range settings {
+		v, src := s.def, settingSource{kind: "default"}
+		if f, ok := cf.values[s.key]; ok && f.set {
+			v, src = f.value, settingSource{kind: "flag"}
+		} else if env, ok := os.LookupEnv(s.key); ok {
+			// set but empty still counts, so it can clear a file value
+			v, src = env, settingSource{kind: "env"}
+		} else if fv, ok := fileValues[s.fileKey()]; ok {
+			v, src = fv, settingSource{kind: "file", file: path}
+		}
+		src.value = strings.TrimSpace(v)
+		sources[s.key] = src
+		if err := s.apply(&cfg, src.value); err != nil {
+			problems = append(problems, src.describe(s)+": "+err.Error())
+		}
+	}
+	if src := sources["AUTH_BACKENDS"]; src.kind == "default" && cfg.LDAPURL != "" {
+		cfg.AuthBackends = []string{"password", "ldap"}
+		src.value = "password,ldap"
+		sources["AUTH_BACKENDS"] = src
+	}
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return Config{}, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	cfg.sources = sources
+	return cfg, nil
+}
+
+// validate checks the rules that involve more than one setting.
+func (c Config) validate() []string {
+	var problems []string
+	if c.Ephemeral && c.DatabaseURL != "" {
+		problems = append(problems, "EPHEMERAL cannot be combined with DATABASE_URL")
+	}
+	if c.BackupEvery > 0 && c.DatabaseURL != "" {
+		problems = append(problems, "BACKUP_INTERVAL_HOURS is only supported with SQLite")
+	}
+	if c.MetricsAddr != "" && !c.MetricsEnabled {
+		problems = append(problems, "METRICS_ADDR requires METRICS_ENABLED")
+	}
+	if c.MetricsAddr != "" && c.MetricsAddr == c.Addr {
+		problems = append(problems, "METRICS_ADDR must differ from ADDR")
+	}
+	if c.MetricsEnabled && c.MetricsAddr == "" && c.MetricsToken == "" {
+		problems = append(problems, "METRICS_ENABLED without METRICS_ADDR requires METRICS_TOKEN")
+	}
+	if c.SessionAbsoluteTTL < c.SessionTTL {
+		problems = append(problems, "SESSION_ABSOLUTE_TTL_HOURS must not be shorter than SESSION_TTL_HOURS")
+	}
+	if c.LoginLockoutMax < c.LoginLockoutBase {
+		problems = append(problems, "LOGIN_LOCKOUT_MAX_MINUTES must not be shorter than LOGIN_LOCKOUT_BASE_SECONDS")
+	}
+	if c.PasswordMaxLength < c.PasswordMinLength {
+		problems = append(problems, fmt.Sprintf("PASSWORD_MAX_LENGTH (%d) must not be less than PASSWORD_MIN_LENGTH (%d)", c.PasswordMaxLength, c.PasswordMinLength))
+	}
+	if len(c.AuthBackends) == 0 {
+		problems = append(problems, "AUTH_BACKENDS must name at least one backend")
+	}
+	if slices.Contains(c.AuthBackends, "ldap") && c.LDAPURL == "" {
+		problems = append(problems, "AUTH_BACKENDS: ldap requires LDAP_URL")
+	}
+	if c.OIDCIssuer != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		problems = append(problems, "OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	if c.PasswordLoginDisabled && c.OIDCIssuer == "" {
+		problems = append(problems, "PASSWORD_LOGIN_DISABLED requires OIDC_ISSUER")
+	}
+	if (c.AdminEmail == "") != (c.AdminPassword == "") {
+		problems = append(problems, "ADMIN_EMAIL and ADMIN_PASSWORD must both be set")
+	}
+	return problems
+}
+
+// printConfig writes the effective configuration as a YAML config file, with
+// each value's source as a comment and secrets redacted.
+func printConfig(w io.Writer, cfg Config) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		src := cfg.sources[s.key]
+		v := src.value
+		switch {
+		case s.key == "DATABASE_URL" && v != "":
+			v = redactURL(v)
+		case s.secret && v != "":
+			v = "REDACTED"
+		}
+
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: s.fileKey()}
+		var val *yaml.Node
+		switch s.kind {
+		case kindList:
+			val = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, item := range splitList(v) {
+				val.Content = append(val.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		case kindBool:
+			b, _ := strconv.ParseBool(v)
+			val = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}
+		case kindInt:
+			val = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: v}
+		case kindFloat:
+			val = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: v}
+		default:
+			val = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+		}
+		val.LineComment = src.kind
+		if src.kind == "file" {
+			val.LineComment = "file " + src.file
+		}
+		doc.Content = append(doc.Content, key, val)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redactURL hides the password of a database URL, in the user info or as a
+// password query parameter.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if q := u.Query(); q.Has("password") {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig runs loadConfig with args as the command line and env as
+// the only settings in the environment.
+func loadTestConfig(t *testing.T, args []string, env map[string]string) (Config, error) {
+	t.Helper()
+	for _, key := range append([]string{"CONFIG_FILE"}, settingKeys()...) {
+		t.Setenv(key, "") // restores the real value afterwards
+		os.Unsetenv(key)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	fs := flag.NewFlagSet("greynote", flag.ContinueOnError)
+	cf := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(cf)
+}
+
+func settingKeys() []string {
+	keys := make([]string, len(settings))
+	for i, s := range settings {
+		keys[i] = s.key
+	}
+	return keys
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "greynote.yaml", "session_ttl_hours: 3\noidc_issuer: https://idp.example\noidc_client_id: greynote\noidc_redirect_url: https://notes.example/api/oidc/callback\n")
+
+	for _, tt := range []struct {
+		name       string
+		flag       string
+		env        *string
+		file       bool
+		want       time.Duration
+		wantSource string
+	}{
+		{"default", "", nil, false, 168 * time.Hour, "default"},
+		{"file over default", "", nil, true, 3 * time.Hour, "file"},
+		{"env over file", "", ptr("2"), true, 2 * time.Hour, "env"},
+		{"flag over env", "1", ptr("2"), true, 1 * time.Hour, "flag"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.flag != "" {
+				args = []string{"-session-ttl-hours", tt.flag}
+			}
+			env := map[string]string{}
+			if tt.env != nil {
+				env["SESSION_TTL_HOURS"] = *tt.env
+			}
+			if tt.file {
+				env["CONFIG_FILE"] = file
+			}
+			cfg, err := loadTestConfig(t, args, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SessionTTL != tt.want || cfg.sources["SESSION_TTL_HOURS"].kind != tt.wantSource {
+				t.Fatalf("SessionTTL = %v from %q, want %v from %q", cfg.SessionTTL, cfg.sources["SESSION_TTL_HOURS"].kind, tt.want, tt.wantSource)
+			}
+		})
+	}
+
+	// an empty variable is a value too: here it turns off SSO from the file
+	cfg, err := loadTestConfig(t, []string{"-config", file}, map[string]string{"OIDC_ISSUER": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OIDCEnabled() || cfg.sources["OIDC_ISSUER"].kind != "env" {
+		t.Fatalf("OIDC_ISSUER = %q from %q, want it cleared by the environment", cfg.OIDCIssuer, cfg.sources["OIDC_ISSUER"].kind)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestConfigFileFormats(t *testing.T) {
+	for _, tt := range []struct {
+		name, content string
+	}{
+		{"greynote.yaml", `
+addr: ":9090"
+cookie_secure: true
+session_ttl_hours: 12
+csrf_trusted_origins: [https://a.example, https://b.example]
+trusted_proxies: 10.0.0.0/8, 192.0.2.1
+`},
+		{"greynote.toml", `
+addr = ":9090"
+cookie_secure = true
+session_ttl_hours = 12
+csrf_trusted_origins = ["https://a.example", "https://b.example"]
+trusted_proxies = "10.0.0.0/8, 192.0.2.1"
+`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, []string{"-config", writeConfigFile(t, tt.name, tt.content)}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Addr != ":9090" || !cfg.CookieSecure || cfg.SessionTTL != 12*time.Hour ||
+				!slices.Equal(cfg.CSRFTrustedOrigins, []string{"https://a.example", "https://b.example"}) ||
+				!slices.Equal(cfg.TrustedProxies, []string{"10.0.0.0/8", "192.0.2.1"}) {
+				t.Fatalf("loaded %+v", cfg)
+			}
+		})
+	}
+}
+
+// Every problem is reported at once, each under the name it was given by.
+func TestConfigValidationMessages(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string // YAML
+		want []string
+	}{
+		{
+			name: "bad values from each source",
+			args: []string{"-session-ttl-hours", "soon"},
+			env:  map[string]string{"COOKIE_SECURE": "yes"},
+			file: "login_max_failures: 0\n",
+			want: []string{
+				`-session-ttl-hours: "soon" is not a whole number`,
+				`COOKIE_SECURE: "yes" is not a boolean (use true/false or 1/0)`,
+				`login_max_failures in `,
+				`: must be at least 1, got 0`,
+			},
+		},
+		{
+			name: "empty env is not a number",
+			env:  map[string]string{"SESSION_TTL_HOURS": ""},
+			want: []string{`SESSION_TTL_HOURS: "" is not a whole number`},
+		},
+		{
+			name: "unknown and nested keys in the file",
+			file: "sesion_ttl_hours: 3\nldap_url:\n  host: ldap.example\n",
+			want: []string{"ldap_url in ", ": nested tables are not allowed", "sesion_ttl_hours in ", ": unknown setting"},
+		},
+		{
+			name: "conflicting settings",
+			env: map[string]string{
+				"EPHEMERAL": "true", "DATABASE_URL": "postgres://localhost/greynote",
+				"SESSION_TTL_HOURS": "48", "SESSION_ABSOLUTE_TTL_HOURS": "24",
+				"ADMIN_EMAIL": "root@example.com",
+			},
+			want: []string{
+				"EPHEMERAL cannot be combined with DATABASE_URL",
+				"SESSION_ABSOLUTE_TTL_HOURS must not be shorter than SESSION_TTL_HOURS",
+				"ADMIN_EMAIL and ADMIN_PASSWORD must both be set",
+			},
+		},
+		{
+			name: "bad trusted proxy",
+			env:  map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8 proxy.internal"},
+			want: []string{`TRUSTED_PROXIES: "proxy.internal" is neither an IP address nor a CIDR range`},
+		},
+		{
+			name: "password lengths",
+			env:  map[string]string{"PASSWORD_MIN_LENGTH": "20", "PASSWORD_MAX_LENGTH": "10"},
+			want: []string{"PASSWORD_MAX_LENGTH (10) must not be less than PASSWORD_MIN_LENGTH (20)"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, "greynote.yaml", tt.file)}, args...)
+			}
+			_, err := loadTestConfig(t, args, tt.env)
+			if err == nil {
+				t.Fatal("loadConfig accepted it")
+			}
+			if !strings.HasPrefix(err.Error(), "invalid configuration:\n  ") {
+				t.Errorf("error does not start with the summary line: %v", err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error lacks %q:\n%v", w, err)
+				}
+			}
+		})
+	}
+
+	if _, err := loadTestConfig(t, []string{"-config", writeConfigFile(t, "greynote.json", "{}")}, nil); err == nil ||
+		!strings.Contains(err.Error(), "unsupported config file type") {
+		t.Fatalf("JSON config file: %v", err)
+	}
+}
@@ -5,68 +5,186 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-func openDB(path string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=5000")
+// connectDB opens the configured database, PostgreSQL if DatabaseURL is set
+// and SQLite otherwise, without touching its schema. Ephemeral mode uses a
+// fresh in-memory SQLite database instead.
+func connectDB(cfg Config) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+	switch {
+	case cfg.Ephemeral:
+		db, err = openMemoryDB()
+	case cfg.DatabaseURL != "":
+		db, err = sql.Open(postgresDriverName, cfg.DatabaseURL)
+	default:
+		db, err = sql.Open(sqliteDriverName, cfg.SQLitePath+"?_foreign_keys=on&_busy_timeout=5000")
+	}
+	return pingDB(db, err)
+}
+
+// connectExistingDB is connectDB for commands that only look at the
+// database: a missing SQLite file is reported instead of created empty.
+func connectExistingDB(cfg Config) (*sql.DB, error) {
+	if cfg.Ephemeral || cfg.DatabaseURL != "" {
+		return connectDB(cfg)
+	}
+	db, err := pingDB(sql.Open(sqliteDriverName, "file:"+cfg.SQLitePath+"?mode=rw&_foreign_keys=on&_busy_timeout=5000"))
+	if err != nil {
+		if _, statErr := os.Stat(cfg.SQLitePath); errors.Is(statErr, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: no such database", cfg.SQLitePath)
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// pingDB takes sql.Open's results and makes sure the database answers.
+func pingDB(db *sql.DB, err error) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
-	if err := migrate(db); err != nil {
+	return db, nil
+}
+
+// openDB connects, applies pending migrations and brings seed data (builtin
+// roles, personal workspaces) up to date.
+func openDB(cfg Config) (*sql.DB, error) {
+	db, err := connectDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareDB(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
 
-func migrate(db *sql.DB) error {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			email TEXT NOT NULL UNIQUE,
-			password_hash TEXT NOT NULL,
-			is_admin INTEGER NOT NULL DEFAULT 0,
-			created_at TEXT NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			token TEXT NOT NULL UNIQUE,
-			expires_at TEXT NOT NULL,
-			created_at TEXT NOT NULL,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS notes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			title TEXT NOT NULL,
-			content TEXT NOT NULL,
-			created_at TEXT NOT NULL,
-			updated_at TEXT NOT NULL,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS share_links (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			note_id INTEGER NOT NULL UNIQUE,
-			token TEXT NOT NULL UNIQUE,
-			is_enabled INTEGER NOT NULL DEFAULT 1,
-			created_at TEXT NOT NULL,
-			FOREIGN KEY(note_id) REFERENCES notes(id) ON DELETE CASCADE
-		);`,
-	}
-	for _, s := range stmts {
-		if _, err := db.Exec(s); err != nil {
+// openMemoryDB opens a new, empty SQLite database that lives only in this
+// process. The memdb VFS lets every pooled connection see the same data; it
+// is freed once the last connection closes, which database/sql only does on
+// Close since idle connections are kept indefinitely by default.
+func openMemoryDB() (*sql.DB, error) {
+	name, err := randomTokenURLSafe(12)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open(sqliteDriverName, "file:/greynote-"+name+"?vfs=memdb&_foreign_keys=on&_busy_timeout=5000")
+}
+
+func prepareDB(db *sql.DB) error {
+	if _, err := migrateUp(db, 0); err != nil {
+		return err
+	}
+	if err := backfillPersonalWorkspaces(db); err != nil {
+		return err
+	}
+	return seedRoles(db)
+}
+
+// checkDatabase runs SQLite's integrity and foreign key checks (SQLite
+// only) and makes sure the database's migrations are known to this build.
+func checkDatabase(db *sql.DB) error {
+	if dialectOf(db) == dialectSQLite {
+		if err := checkSQLiteIntegrity(db); err != nil {
 			return err
 		}
 	}
+
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("not a GreyNote database (no schema_migrations table)")
+	}
+	all, err := loadMigrations(dialectOf(db))
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	return verifyMigrations(all, applied)
+}
+
+func checkSQLiteIntegrity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("not a readable SQLite database: %w", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			rows.Close()
+			return err
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	var fkViolations int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&fkViolations); err != nil {
+		return err
+	}
+	if fkViolations > 0 {
+		return fmt.Errorf("foreign key check failed: %d violations", fkViolations)
+	}
 	return nil
 }
 
+// ensureColumn runs ddl unless table already has the given column.
+func ensureColumn(db *sql.DB, table, column, ddl string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = db.Exec(ddl)
+	return err
+}
+
+// databaseLabel describes the configured database for log lines, without
+// the password.
+func (cfg Config) databaseLabel() string {
+	if cfg.Ephemeral {
+		return "in-memory, ephemeral"
+	}
+	if cfg.DatabaseURL == "" {
+		return "sqlite=" + cfg.SQLitePath
+	}
+	u, err := url.Parse(cfg.DatabaseURL)
+	if err != nil {
+		return "postgres"
+	}
+	return "postgres=" + u.Redacted()
+}
+
 func nowRFC3339() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
@@ -80,4 +198,9 @@ func randomTokenURLSafe(nBytes int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// escapeLike escapes the LIKE wildcards in s for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
 var ErrNotFound = errors.New("not found")
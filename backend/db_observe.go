@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Both database drivers are registered wrapped in observedDriver, which
+// times every statement and reports it to observeQuery for metrics and
+// tracing. Everything else is passed through to the real driver.
+
+const sqliteDriverName = "greynote-sqlite"
+
+func init() {
+	sql.Register(sqliteDriverName, observedDriver{&sqlite3.SQLiteDriver{}, semconv.DBSystemSqlite})
+}
+
+// observeQuery is called once a statement has run (for queries: once the
+// first rows are available).
+func observeQuery(ctx context.Context, system attribute.KeyValue, op, query string, start time.Time, err error) {
+	dbQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	traceQuery(ctx, system, query, start, err)
+}
+
+type observedDriver struct {
+	driver.Driver
+	system attribute.KeyValue // db.system, for spans
+}
+
+func (d observedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{conn, d.system}, nil
+}
+
+// sqliteConn returns the *sqlite3.SQLiteConn behind a raw connection from
+// sql.Conn.Raw, wrapped or not.
+func sqliteConn(dc any) *sqlite3.SQLiteConn {
+	if o, ok := dc.(*observedConn); ok {
+		dc = o.Conn
+	}
+	return dc.(*sqlite3.SQLiteConn)
+}
+
+type observedConn struct {
+	driver.Conn
+	system attribute.KeyValue
+}
+
+// PrepareContext passes prepared statements through untimed: the server
+// never prepares statements itself, and both drivers run queries directly.
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *observedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, c.system, "exec", query, start, err)
+	}
+	return res, err
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, c.system, "query", query, start, err)
+	}
+	return rows, err
+}
+
+func (c *observedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *observedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *observedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *observedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if ch, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return ch.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// lockSQLite is only implemented on Unix; see dblock_unix.go.
+func lockSQLite(path string, exclusive bool) (release func(), err error) {
+	return nil, errors.ErrUnsupported
+}
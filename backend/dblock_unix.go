@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockSQLite locks the file next to the SQLite database at path. Servers
+// take it shared for as long as they run; restore takes it exclusively and
+// so fails with errDatabaseLocked while any server has the database open.
+// The lock goes away with the process, so a crash cannot leave it behind.
+func lockSQLite(path string, exclusive bool) (release func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errDatabaseLocked
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testConfig returns the default configuration with overrides applied, the
+// way loadConfig would build it from the environment. Tests run on an
+// ephemeral database and with cheap password hashing unless told otherwise.
+func testConfig(t *testing.T, overrides map[string]string) Config {
+	t.Helper()
+	values := map[string]string{
+		"EPHEMERAL":     "true",
+		"PASSWORD_HASH": passwordAlgoBcrypt,
+		"BCRYPT_COST":   "4",
+	}
+	for k, v := range overrides {
+		values[k] = v
+	}
+
+	var cfg Config
+	for _, s := range settings {
+		v, ok := values[s.key]
+		if !ok {
+			v = s.def
+		}
+		delete(values, s.key)
+		if err := s.apply(&cfg, v); err != nil {
+			t.Fatalf("%s: %v", s.key, err)
+		}
+	}
+	for k := range values {
+		t.Fatalf("unknown setting %s", k)
+	}
+	if problems := cfg.validate(); len(problems) > 0 {
+		t.Fatalf("invalid test configuration: %v", problems)
+	}
+	return cfg
+}
+
+// testServer serves NewRouter over a fresh database.
+type testServer struct {
+	*httptest.Server
+	DB        *sql.DB
+	Cfg       Config
+	Passwords *Passwords
+}
+
+func newTestServer(t *testing.T, overrides map[string]string) *testServer {
+	t.Helper()
+	cfg := testConfig(t, overrides)
+	return serveTestDB(t, openTestDB(t, cfg), cfg)
+}
+
+func openTestDB(t *testing.T, cfg Config) *sql.DB {
+	t.Helper()
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// serveTestDB serves NewRouter over db, which need not be the database cfg
+// names.
+func serveTestDB(t *testing.T, db *sql.DB, cfg Config) *testServer {
+	t.Helper()
+	pw, err := NewPasswords(cfg)
+	if err != nil {
+		t.Fatalf("NewPasswords: %v", err)
+	}
+	srv := httptest.NewServer(NewRouter(db, NewSQLStore(db), cfg, pw))
+	t.Cleanup(srv.Close)
+	return &testServer{Server: srv, DB: db, Cfg: cfg, Passwords: pw}
+}
+
+// createUser adds a password user directly to the database.
+func (ts *testServer) createUser(t *testing.T, email, password string, superuser bool) int64 {
+	t.Helper()
+	hash, err := ts.Passwords.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := User{Email: email, IsAdmin: superuser, CreatedAt: nowRFC3339()}
+	if err := NewSQLStore(ts.DB).CreateUser(context.Background(), &u, hash); err != nil {
+		t.Fatalf("create %s: %v", email, err)
+	}
+	return u.ID
+}
+
+// testClient is a browser-like client: it keeps cookies, does not follow
+// redirects and sends the CSRF token it learned from /api/me. Like a
+// browser on another site, it sends origin as the Origin header if set.
+// header is added to every request.
+type testClient struct {
+	t      *testing.T
+	ts     *testServer
+	http   *http.Client
+	csrf   string
+	origin string
+	header http.Header
+}
+
+func (ts *testServer) client(t *testing.T) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, ts: ts, http: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// do sends body as JSON (unless it is nil) and returns the response with its
+// body read.
+func (c *testClient) do(method, path string, body any) (*http.Response, []byte) {
+	c.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.ts.URL+path, r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.csrf != "" {
+		req.Header.Set(csrfHeader, c.csrf)
+	}
+	if c.origin != "" {
+		req.Header.Set("Origin", c.origin)
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, data
+}
+
+// call is do for requests expected to answer want; a JSON response is
+// decoded into out if it is not nil.
+func (c *testClient) call(method, path string, body any, want int, out any) {
+	c.t.Helper()
+	resp, data := c.do(method, path, body)
+	if resp.StatusCode != want {
+		c.t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			c.t.Fatalf("%s %s: %v: %s", method, path, err, data)
+		}
+	}
+}
+
+type meResponse struct {
+	UserID      int64    `json:"userId"`
+	Email       string   `json:"email"`
+	IsAdmin     bool     `json:"isAdmin"`
+	Permissions []string `json:"permissions"`
+	CSRFToken   string   `json:"csrfToken"`
+}
+
+// me fetches /api/me and remembers the session's CSRF token.
+func (c *testClient) me() meResponse {
+	c.t.Helper()
+	var me meResponse
+	c.call(http.MethodGet, "/api/me", nil, http.StatusOK, &me)
+	c.csrf = me.CSRFToken
+	return me
+}
+
+func (c *testClient) login(email, password string) meResponse {
+	c.t.Helper()
+	c.call(http.MethodPost, "/api/login", gin.H{"email": email, "password": password}, http.StatusNoContent, nil)
+	return c.me()
+}
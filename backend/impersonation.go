@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Impersonation lets an admin see the app as a given user through a separate,
+// fixed-length session. Each one is recorded in the impersonations table,
+// which has no foreign keys so the record outlives both accounts.
+
+// NotImpersonating rejects the request when it comes from an "act as user"
+// session. It guards the admin API and anything that changes credentials.
+// Must run after AuthRequired.
+func NotImpersonating() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetInt64(ginImpersonationKey) != 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed while impersonating"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type impersonateReq struct {
+	Reason string `json:"reason"`
+}
+
+// POST /api/admin/users/:id/impersonate
+// Replaces the admin's session cookie with one for the target user. The
+// admin's own session is kept and restored by EndImpersonation.
+func (h *AuthHandlers) StartImpersonationAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID := h.checkManageable(c)
+	if targetID == 0 {
+		return
+	}
+
+	var req impersonateReq
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+			return
+		}
+	}
+
+	target, err := h.Store.UserByID(ctx, targetID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if target.SuspendedAt != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	token, err := randomTokenURLSafe(32)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+	csrfToken, err := randomTokenURLSafe(32)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(h.Cfg.ImpersonationTTL)
+
+	imp := Impersonation{
+		AdminID:        getUserID(c),
+		UserID:         targetID,
+		AdminSessionID: getSessionID(c),
+		Reason:         req.Reason,
+		IP:             c.ClientIP(),
+		StartedAt:      now.Format(time.RFC3339),
+		ExpiresAt:      expiresAt.Format(time.RFC3339),
+	}
+	sess := Session{
+		UserID:     targetID,
+		Token:      token,
+		CSRFToken:  csrfToken,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now.Format(time.RFC3339),
+		LastSeenAt: now.Format(time.RFC3339),
+		ExpiresAt:  expiresAt.Format(time.RFC3339),
+	}
+	if err := h.Store.StartImpersonation(ctx, &imp, &sess); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	writeAudit(h.Store, c, getUserID(c), auditImpersonationStart, auditTarget("user", targetID),
+		gin.H{"impersonationId": imp.ID, "reason": req.Reason})
+
+	setSessionCookie(c, h.Cfg, token, expiresAt.Sub(now))
+	c.JSON(http.StatusOK, gin.H{
+		"userId":    targetID,
+		"email":     target.Email,
+		"expiresAt": expiresAt.Format(time.RFC3339),
+	})
+}
+
+// POST /api/me/impersonation/end
+// Ends the current "act as user" session and, if it is still valid, puts the
+// admin's own session back in the cookie.
+func (h *AuthHandlers) EndImpersonation(c *gin.Context) {
+	ctx := c.Request.Context()
+	impersonationID := c.GetInt64(ginImpersonationKey)
+	if impersonationID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not impersonating"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := h.Store.EndImpersonation(ctx, impersonationID, now.Format(time.RFC3339)); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := h.Store.DeleteSession(ctx, getSessionID(c)); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	imp, err := h.Store.Impersonation(ctx, impersonationID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, imp.AdminID, auditImpersonationEnd, auditTarget("user", getUserID(c)), nil)
+
+	admin, err := h.Store.Session(ctx, imp.AdminSessionID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		internalError(c, "db error", err)
+		return
+	}
+	if err != nil || admin.UserID != imp.AdminID || admin.ExpiresAt <= now.Format(time.RFC3339) {
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(h.Cfg.CookieName, "", -1, "/", "", h.Cfg.CookieSecure, true)
+		c.JSON(http.StatusOK, gin.H{"restored": false})
+		return
+	}
+
+	exp, _ := time.Parse(time.RFC3339, admin.ExpiresAt)
+	setSessionCookie(c, h.Cfg, admin.Token, exp.Sub(now))
+	c.JSON(http.StatusOK, gin.H{"restored": true})
+}
+
+type impersonationDTO struct {
+	ID         int64  `json:"id"`
+	AdminID    int64  `json:"adminId"`
+	AdminEmail string `json:"adminEmail"`
+	UserID     int64  `json:"userId"`
+	UserEmail  string `json:"userEmail"`
+	Reason     string `json:"reason"`
+	IP         string `json:"ip"`
+	StartedAt  string `json:"startedAt"`
+	ExpiresAt  string `json:"expiresAt"`
+	// EndedAt is when the admin ended the session, or its expiry once that
+	// has passed; empty while it is still active.
+	EndedAt string `json:"endedAt"`
+}
+
+// GET /api/admin/impersonations
+func (h *AuthHandlers) ListImpersonationsAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	imps, err := h.Store.ListImpersonations(ctx, 200)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	now := nowRFC3339()
+	out := make([]impersonationDTO, 0, len(imps))
+	for _, i := range imps {
+		d := impersonationDTO{
+			ID:         i.ID,
+			AdminID:    i.AdminID,
+			AdminEmail: i.AdminEmail,
+			UserID:     i.UserID,
+			UserEmail:  i.UserEmail,
+			Reason:     i.Reason,
+			IP:         i.IP,
+			StartedAt:  i.StartedAt,
+			ExpiresAt:  i.ExpiresAt,
+			EndedAt:    i.EndedAt,
+		}
+		if d.EndedAt == "" && d.ExpiresAt <= now {
+			d.EndedAt = d.ExpiresAt
+		}
+		out = append(out, d)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
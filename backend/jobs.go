@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job is a periodic background task. It runs once when the runner starts,
+// to catch up on whatever piled up while the server was down, and then
+// every Every. Run should return promptly once ctx is cancelled.
+type Job struct {
+	Name  string
+	Every time.Duration
+	Run   func(ctx context.Context) error
+}
+
+// sweepJob wraps a cleanup that reports how many rows it removed.
+func sweepJob(what string, every time.Duration, sweep func(context.Context) (int64, error)) Job {
+	return Job{"sweep " + what, every, func(ctx context.Context) error {
+		n, err := sweep(ctx)
+		if err == nil && n > 0 {
+			slog.Info("sweep", "removed", n, "what", what)
+		}
+		return err
+	}}
+}
+
+// JobRunner runs Jobs in the background, each on its own schedule, until
+// Stop is called.
+type JobRunner struct {
+	jobs   []Job
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewJobRunner(jobs ...Job) *JobRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobRunner{jobs: jobs, ctx: ctx, cancel: cancel}
+}
+
+func (r *JobRunner) Start() {
+	for _, j := range r.jobs {
+		r.wg.Add(1)
+		go r.loop(j)
+	}
+}
+
+func (r *JobRunner) loop(j Job) {
+	defer r.wg.Done()
+
+	run := func() {
+		if err := j.Run(r.ctx); err != nil && r.ctx.Err() == nil {
+			slog.Error("job failed", "job", j.Name, "error", err)
+		}
+	}
+	run()
+
+	t := time.NewTicker(j.Every)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+			run()
+		}
+	}
+}
+
+// Stop cancels the jobs and waits for runs in progress to return, or for
+// ctx to expire, whichever comes first.
+func (r *JobRunner) Stop(ctx context.Context) error {
+	r.cancel()
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPAuthenticator finds the user's entry with a service-account search,
+// then verifies the password by binding as that entry. Local accounts are
+// created on first successful login.
+type LDAPAuthenticator struct {
+	Store Store
+	Cfg   Config
+}
+
+func NewLDAPAuthenticator(store Store, cfg Config) *LDAPAuthenticator {
+	return &LDAPAuthenticator{Store: store, Cfg: cfg}
+}
+
+func (a *LDAPAuthenticator) Name() string { return "ldap" }
+
+// ldapTimeout bounds connecting and each request to the directory, unless
+// the login request runs out of time first.
+const ldapTimeout = 10 * time.Second
+
+func (a *LDAPAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := ldapTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := ldap.DialURL(a.Cfg.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if a.Cfg.LDAPStartTLS {
+		u, err := url.Parse(a.Cfg.LDAPURL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, email, password string) (int64, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if password == "" {
+		return 0, ErrBadPassword
+	}
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// a client that gives up takes its pending directory requests with it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if a.Cfg.LDAPBindDN != "" {
+		err = conn.Bind(a.Cfg.LDAPBindDN, a.Cfg.LDAPBindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("service bind: %w", err)
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.Cfg.LDAPBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.ReplaceAll(a.Cfg.LDAPUserFilter, "%s", ldap.EscapeFilter(email)),
+		[]string{a.Cfg.LDAPGroupAttr},
+		nil,
+	))
+	if err != nil {
+		return 0, fmt.Errorf("search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return 0, ErrUnknownUser
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return 0, ErrBadPassword
+		}
+		return 0, fmt.Errorf("user bind: %w", err)
+	}
+
+	isAdmin := false
+	if a.Cfg.LDAPAdminGroup != "" {
+		for _, g := range entry.GetAttributeValues(a.Cfg.LDAPGroupAttr) {
+			if strings.EqualFold(g, a.Cfg.LDAPAdminGroup) {
+				isAdmin = true
+				break
+			}
+		}
+	}
+
+	return a.provisionUser(ctx, email, isAdmin)
+}
+
+// provisionUser returns the local account for email, creating it if needed,
+// and keeps the superuser role in sync with the directory when an admin
+// group is set.
+func (a *LDAPAuthenticator) provisionUser(ctx context.Context, email string, isAdmin bool) (int64, error) {
+	u, err := a.Store.UserByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		// directory accounts get an empty hash, which never matches a password
+		u = User{Email: email, CreatedAt: nowRFC3339()}
+		err = a.Store.CreateUser(ctx, &u, "")
+	}
+	if err != nil {
+		return 0, err
+	}
+	userID := u.ID
+
+	if a.Cfg.LDAPAdminGroup != "" {
+		if err := a.Store.SetSuperuser(ctx, userID, isAdmin); err != nil {
+			return 0, err
+		}
+	}
+	return userID, nil
+}
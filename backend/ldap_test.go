@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	mockLDAPBindDN       = "cn=svc,dc=example,dc=com"
+	mockLDAPBindPassword = "svc-password"
+	mockLDAPAdminGroup   = "cn=greynote-admins,ou=groups,dc=example,dc=com"
+)
+
+type mockLDAPEntry struct {
+	dn, mail, password string
+	groups             []string
+}
+
+// mockLDAP is an in-process directory that understands just enough of LDAP
+// for LDAPAuthenticator: simple binds, (mail=...) searches and unbind.
+type mockLDAP struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	entries map[string]*mockLDAPEntry // by mail
+}
+
+func newMockLDAP(t *testing.T, entries ...*mockLDAPEntry) *mockLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockLDAP{ln: ln, entries: map[string]*mockLDAPEntry{}}
+	for _, e := range entries {
+		m.entries[e.mail] = e
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return m
+}
+
+func (m *mockLDAP) URL() string { return "ldap://" + m.ln.Addr().String() }
+
+func (m *mockLDAP) setGroups(mail string, groups ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[mail].groups = groups
+}
+
+func (m *mockLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		var replies []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if m.checkBind(dn, password) {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			replies = append(replies, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if bound != mockLDAPBindDN {
+				replies = append(replies, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				break
+			}
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			replies = append(replies, m.search(filter)...)
+			replies = append(replies, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default: // unbind, or anything this mock does not implement
+			return
+		}
+
+		for _, r := range replies {
+			env := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			env.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			env.AppendChild(r)
+			if _, err := conn.Write(env.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *mockLDAP) checkBind(dn, password string) bool {
+	if dn == mockLDAPBindDN {
+		return password == mockLDAPBindPassword
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.dn == dn {
+			return password == e.password
+		}
+	}
+	return false
+}
+
+func (m *mockLDAP) search(filter string) []*ber.Packet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*ber.Packet
+	for _, e := range m.entries {
+		if filter != "(mail="+ldap.EscapeFilter(e.mail)+")" {
+			continue
+		}
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", ""))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, g := range e.groups {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, g, ""))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+		entry.AppendChild(attrs)
+		out = append(out, entry)
+	}
+	return out
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return res
+}
+
+func ldapSettings(url string) map[string]string {
+	return map[string]string{
+		"AUTH_BACKENDS":      "password,ldap",
+		"LDAP_URL":           url,
+		"LDAP_BIND_DN":       mockLDAPBindDN,
+		"LDAP_BIND_PASSWORD": mockLDAPBindPassword,
+		"LDAP_BASE_DN":       "ou=people,dc=example,dc=com",
+		"LDAP_ADMIN_GROUP":   mockLDAPAdminGroup,
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	dir := newMockLDAP(t,
+		&mockLDAPEntry{dn: "uid=alice,ou=people,dc=example,dc=com", mail: "alice@example.com", password: "alice-password", groups: []string{"cn=staff,ou=groups,dc=example,dc=com"}},
+		&mockLDAPEntry{dn: "uid=bob,ou=people,dc=example,dc=com", mail: "bob@example.com", password: "bob-password", groups: []string{mockLDAPAdminGroup}},
+	)
+	ts := newTestServer(t, ldapSettings(dir.URL()))
+
+	alice := ts.client(t).login("Alice@Example.com", "alice-password")
+	if alice.Email != "alice@example.com" || alice.IsAdmin {
+		t.Fatalf("alice: %+v", alice)
+	}
+	if again := ts.client(t).login("alice@example.com", "alice-password"); again.UserID != alice.UserID {
+		t.Fatalf("second login created user %d, want %d", again.UserID, alice.UserID)
+	}
+
+	for _, creds := range []gin.H{
+		{"email": "alice@example.com", "password": "wrong"},
+		{"email": "nobody@example.com", "password": "alice-password"},
+	} {
+		ts.client(t).call(http.MethodPost, "/api/login", creds, http.StatusUnauthorized, nil)
+	}
+
+	bob := ts.client(t).login("bob@example.com", "bob-password")
+	if !bob.IsAdmin || !slices.Contains(bob.Permissions, permAll) {
+		t.Fatalf("bob, in the admin group: %+v", bob)
+	}
+	dir.setGroups("bob@example.com")
+	if bob = ts.client(t).login("bob@example.com", "bob-password"); bob.IsAdmin || slices.Contains(bob.Permissions, permAll) {
+		t.Fatalf("bob, removed from the admin group: %+v", bob)
+	}
+}
+
+func TestLDAPGivesUpWithTheRequest(t *testing.T) {
+	// accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // held open, silent, until the test ends
+		}
+	}()
+
+	a := NewLDAPAuthenticator(nil, testConfig(t, ldapSettings("ldap://"+ln.Addr().String())))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := a.Authenticate(ctx, "alice@example.com", "alice-password"); err == nil {
+		t.Fatal("login against an unresponsive directory succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("login took %v, want about the request's 200ms", d)
+	}
+}
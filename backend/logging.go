@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The server logs with log/slog, one JSON object per line unless
+// LOG_FORMAT=text. Every request carries an ID, taken from a well-formed
+// incoming X-Request-ID or generated, which is echoed in the response, added
+// to the request's log lines and returned in 5xx bodies so that a user's
+// report can be matched to the log.
+
+const (
+	requestIDHeader = "X-Request-ID"
+	ginRequestIDKey = "requestID"
+)
+
+// requestIDPattern is what is accepted from clients: enough for UUIDs and
+// trace IDs, nothing that could garble a log line.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// setupLogging installs the server's slog handler as the default logger.
+// Whatever libraries write through the log package ends up there too, at
+// info level.
+func setupLogging(cfg Config) {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var h slog.Handler
+	if cfg.LogFormat == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+
+	// gin's debug mode prints its route table as plain text
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+}
+
+func newRequestID() string {
+	id, err := randomTokenURLSafe(12)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return id
+}
+
+// RequestID assigns the request its ID.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(ginRequestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func requestID(c *gin.Context) string {
+	return c.GetString(ginRequestIDKey)
+}
+
+// requestLogger returns the default logger with the request's ID, route and,
+// once AuthRequired has run, user.
+func requestLogger(c *gin.Context) *slog.Logger {
+	l := slog.With("request_id", requestID(c), "method", c.Request.Method, "route", c.FullPath())
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	if userID := getUserID(c); userID != 0 {
+		l = l.With("user_id", userID)
+	}
+	return l
+}
+
+// loggedPath is the request path for logs and spans. Share, reset and
+// invitation links carry their secret in the path, so for those it is the
+// route pattern instead.
+func loggedPath(c *gin.Context) string {
+	if route := c.FullPath(); strings.Contains(route, ":token") {
+		return route
+	}
+	return c.Request.URL.Path
+}
+
+// internalError logs err and answers 500 with msg and the request ID.
+func internalError(c *gin.Context, msg string, err error) {
+	requestLogger(c).Error(msg, "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": msg, "requestId": requestID(c)})
+}
+
+// AccessLog writes one line per request once it has been handled.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"status", status,
+			"path", loggedPath(c),
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", max(c.Writer.Size(), 0),
+			"client_ip", c.ClientIP(),
+		}
+		if errs := c.Errors.ByType(gin.ErrorTypePrivate); len(errs) > 0 {
+			attrs = append(attrs, "errors", errs.String())
+		}
+		requestLogger(c).Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery turns a panic into a logged 500 instead of a dropped connection.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		requestLogger(c).Error("panic", "panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error", "requestId": requestID(c)})
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoginThrottle tracks failed logins per client IP and per account email and
+// locks a key out with exponential backoff once it passes its failure limit.
+type LoginThrottle struct {
+	Store Store
+	Cfg   Config
+}
+
+func NewLoginThrottle(store Store, cfg Config) *LoginThrottle {
+	return &LoginThrottle{Store: store, Cfg: cfg}
+}
+
+const (
+	lockoutKindIP    = "ip"
+	lockoutKindEmail = "email"
+)
+
+func (t *LoginThrottle) limit(kind string) int {
+	if kind == lockoutKindIP {
+		return t.Cfg.LoginMaxFailuresPerIP
+	}
+	return t.Cfg.LoginMaxFailures
+}
+
+// lockoutFor returns how long a key stays locked after its nth failure.
+func (t *LoginThrottle) lockoutFor(kind string, failures int) time.Duration {
+	over := failures - t.limit(kind)
+	if over < 0 {
+		return 0
+	}
+	d := t.Cfg.LoginLockoutBase
+	for i := 0; i < over && d < t.Cfg.LoginLockoutMax; i++ {
+		d *= 2
+	}
+	if d > t.Cfg.LoginLockoutMax {
+		d = t.Cfg.LoginLockoutMax
+	}
+	return d
+}
+
+// lockoutKeys returns the two keys a login attempt counts against.
+func lockoutKeys(ip, email string) []Lockout {
+	return []Lockout{{Kind: lockoutKindIP, Value: ip}, {Kind: lockoutKindEmail, Value: email}}
+}
+
+// Check reports how long the caller must wait before trying again, or 0 if
+// neither the IP nor the account is locked.
+func (t *LoginThrottle) Check(ctx context.Context, ip, email string) (time.Duration, error) {
+	now := time.Now().UTC()
+	var wait time.Duration
+	for _, key := range lockoutKeys(ip, email) {
+		l, err := t.Store.LoginLockout(ctx, key.Kind, key.Value)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		until, err := time.Parse(time.RFC3339, l.LockedUntil)
+		if err != nil {
+			continue
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// RecordFailure logs the attempt and bumps the failure counters of both keys.
+func (t *LoginThrottle) RecordFailure(ctx context.Context, ip, email, reason string) error {
+	now := time.Now().UTC()
+	attempt := LoginAttempt{Email: email, IP: ip, Reason: reason, CreatedAt: now.Format(time.RFC3339)}
+	return t.Store.RecordLoginFailure(ctx, attempt, func(l Lockout) Lockout {
+		// a key that has been quiet for a full max lockout starts over
+		if last, err := time.Parse(time.RFC3339, l.LastFailureAt); err == nil && now.Sub(last) > t.Cfg.LoginLockoutMax {
+			l.Failures = 0
+		}
+		l.Failures++
+
+		l.LockedUntil = ""
+		if d := t.lockoutFor(l.Kind, l.Failures); d > 0 {
+			l.LockedUntil = now.Add(d).Format(time.RFC3339)
+		}
+		l.LastFailureAt = now.Format(time.RFC3339)
+		return l
+	})
+}
+
+// RecordSuccess clears the account's failure counter. The IP counter is kept
+// so that one valid login cannot be used to reset guessing against others.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, email string) error {
+	return t.Store.DeleteLoginLockout(ctx, lockoutKindEmail, email)
+}
+
+// Purge deletes counters that have been quiet for a full max lockout, which
+// would start over on the next failure anyway, and attempts older than
+// LoginAttemptRetention.
+func (t *LoginThrottle) Purge(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+	return t.Store.PurgeLoginThrottle(ctx,
+		now.Add(-t.Cfg.LoginLockoutMax).Format(time.RFC3339),
+		now.Add(-t.Cfg.LoginAttemptRetention).Format(time.RFC3339),
+	)
+}
+
+// GET /api/admin/lockouts
+func (t *LoginThrottle) ListLockoutsAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	lockouts, err := t.Store.LoginLockouts(ctx)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	type row struct {
+		ID            int64  `json:"id"`
+		Kind          string `json:"kind"`
+		Value         string `json:"value"`
+		Failures      int    `json:"failures"`
+		LockedUntil   string `json:"lockedUntil,omitempty"`
+		LastFailureAt string `json:"lastFailureAt"`
+		Locked        bool   `json:"locked"`
+	}
+
+	now := time.Now().UTC()
+	out := make([]row, 0, len(lockouts))
+	for _, l := range lockouts {
+		r := row{ID: l.ID, Kind: l.Kind, Value: l.Value, Failures: l.Failures, LockedUntil: l.LockedUntil, LastFailureAt: l.LastFailureAt}
+		if until, err := time.Parse(time.RFC3339, r.LockedUntil); err == nil {
+			r.Locked = until.After(now)
+		}
+		out = append(out, r)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// DELETE /api/admin/lockouts/:id
+func (t *LoginThrottle) ClearLockoutAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad lockout id"})
+		return
+	}
+
+	l, err := t.Store.ClearLoginLockout(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(t.Store, c, getUserID(c), auditLockoutClear, auditTarget("lockout", id), gin.H{"kind": l.Kind, "value": l.Value})
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/admin/login-attempts?email=&ip=&limit=
+func (t *LoginThrottle) ListAttemptsAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	attempts, err := t.Store.LoginAttempts(ctx, c.Query("email"), c.Query("ip"), limit)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	type row struct {
+		ID        int64  `json:"id"`
+		Email     string `json:"email"`
+		IP        string `json:"ip"`
+		Reason    string `json:"reason"`
+		CreatedAt string `json:"createdAt"`
+	}
+
+	out := make([]row, 0, len(attempts))
+	for _, a := range attempts {
+		out = append(out, row{ID: a.ID, Email: a.Email, IP: a.IP, Reason: a.Reason, CreatedAt: a.CreatedAt})
+	}
+
+	c.JSON(http.StatusOK, out)
+}
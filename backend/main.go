@@ -1,121 +1,169 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
-
-	"github.com/gin-gonic/gin"
 )
 
-type Config struct {
-	Addr           string
-	SQLitePath     string
-	FrontendOrigin string
-
-	CookieName   string
-	CookieSecure bool
-
-	SessionTTL    time.Duration
-	AdminEmail    string
-	AdminPassword string
-}
-
-func getenv(key, def string) string {
-	v := os.Getenv(key)
-	if v == "" {
-		return def
+func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		slog.Error("exiting", "error", err)
+		os.Exit(1)
 	}
-	return v
 }
 
-func mustLoadConfig() Config {
-	addr := getenv("ADDR", ":8080")
-	sqlitePath := getenv("SQLITE_PATH", "./notes.db")
-	frontendOrigin := getenv("FRONTEND_ORIGIN", "http://localhost:5173")
-
-	cookieName := getenv("COOKIE_NAME", "notes_session")
-	cookieSecure := getenv("COOKIE_SECURE", "0") == "1"
-
-	ttlHours, err := strconv.Atoi(getenv("SESSION_TTL_HOURS", "168"))
-	if err != nil || ttlHours <= 0 {
-		ttlHours = 168
+// runServe runs the HTTP server until it fails or is told to stop.
+func runServe(cfg Config, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: serve (settings go before the command, e.g. greynote -addr :9090 serve)")
 	}
-	adminEmail := getenv("ADMIN_EMAIL", "")
-	adminPassword := getenv("ADMIN_PASSWORD", "")
-
-	return Config{
-		Addr:           addr,
-		SQLitePath:     sqlitePath,
-		FrontendOrigin: frontendOrigin,
-		CookieName:     cookieName,
-		CookieSecure:   cookieSecure,
-		SessionTTL:     time.Duration(ttlHours) * time.Hour,
-		AdminEmail:     adminEmail,
-		AdminPassword:  adminPassword,
+	setupLogging(cfg)
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	if cfg.Ephemeral && cfg.AdminEmail == "" {
+		slog.Warn("ephemeral mode without ADMIN_EMAIL/ADMIN_PASSWORD: nobody will be able to sign in")
 	}
-}
 
-func main() {
-	cfg := mustLoadConfig()
+	// keeps restore from swapping the database file underneath us
+	if cfg.DatabaseURL == "" && !cfg.Ephemeral {
+		release, err := lockSQLite(cfg.SQLitePath, false)
+		switch {
+		case errors.Is(err, errDatabaseLocked):
+			return fmt.Errorf("%s is being restored", cfg.SQLitePath)
+		case errors.Is(err, errors.ErrUnsupported):
+			slog.Warn("cannot lock the database file on this platform: restore will not notice the running server")
+		case err != nil:
+			return fmt.Errorf("lock %s: %w", cfg.SQLitePath, err)
+		default:
+			defer release()
+		}
+	}
 
-	db, err := openDB(cfg.SQLitePath)
+	db, err := openDB(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.Close()
-	if err := ensureAdminUser(db, cfg.AdminEmail, cfg.AdminPassword); err != nil {
-		log.Fatal(err)
+	// left open if a job outlives the shutdown timeout, see below
+	keepDBOpen := false
+	defer func() {
+		if !keepDBOpen {
+			db.Close()
+		}
+	}()
+	passwords, err := NewPasswords(cfg)
+	if err != nil {
+		return err
+	}
+	if err := ensureAdminUser(db, passwords, cfg.AdminEmail, cfg.AdminPassword); err != nil {
+		return err
 	}
 
-	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
-	r.Use(CORSMiddleware(cfg.FrontendOrigin))
-
-	// health
-	r.GET("/health", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
-
-	auth := NewAuthHandlers(db, cfg)
-	notes := NewNotesHandlers(db)
-
-	api := r.Group("/api")
-	{
-		// auth (public)
-		//api.POST("/register", auth.Register)
-		api.POST("/login", auth.Login)
-		api.POST("/logout", auth.Logout)
+	store := NewSQLStore(db)
+	r := NewRouter(db, store, cfg, passwords)
 
-		// share (public)
-		api.GET("/share/:token", notes.GetShared)
+	jobs := []Job{
+		sweepJob("expired sessions", cfg.SessionSweepEvery, func(ctx context.Context) (int64, error) { return store.PurgeExpiredSessions(ctx, nowRFC3339()) }),
+		sweepJob("accounts past their deletion date", cfg.SessionSweepEvery, func(ctx context.Context) (int64, error) { return purgeDueDeletions(ctx, store) }),
+		sweepJob("stale login throttling data", cfg.SessionSweepEvery, NewLoginThrottle(store, cfg).Purge),
+		sweepJob("expired password reset links", cfg.SessionSweepEvery, func(ctx context.Context) (int64, error) { return store.PurgeExpiredPasswordResets(ctx, nowRFC3339()) }),
+		sweepJob("expired workspace invitations", cfg.SessionSweepEvery, func(ctx context.Context) (int64, error) { return purgeExpiredInvitations(ctx, db) }),
+	}
+	if cfg.BackupEvery > 0 {
+		jobs = append(jobs, backupJob(db, cfg))
+	}
+	runner := NewJobRunner(jobs...)
+
+	srv := &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: min(cfg.HTTPReadTimeout, 10*time.Second),
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
 
-		// authenticated
-		pr := api.Group("/")
-		pr.Use(AuthRequired(db, cfg.CookieName))
-		{
-			admin := pr.Group("/admin")
-			admin.Use(AdminRequired(db))
-			{
-				admin.GET("/users", auth.ListUsersAdmin)
-				admin.POST("/users", auth.CreateUserAdmin)
-				admin.PUT("/users/:id/admin", auth.SetAdminFlag)
-				admin.DELETE("/users/:id", auth.DeleteUserAdmin)
-			}
+	if cfg.MetricsEnabled {
+		registerDBMetrics(db)
+	}
+	// with METRICS_ADDR, /metrics gets its own listener, e.g. one that is
+	// only reachable from the monitoring network
+	var metricsSrv *http.Server
+	var metricsLn net.Listener
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(cfg.MetricsToken))
+		metricsSrv = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          srv.ErrorLog,
+		}
+		if metricsLn, err = net.Listen("tcp", cfg.MetricsAddr); err != nil {
+			ln.Close()
+			return err
+		}
+	}
 
-			pr.GET("/me", auth.Me)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			pr.GET("/notes", notes.List)
-			pr.POST("/notes", notes.Create)
-			pr.GET("/notes/:id", notes.Get)
-			pr.PUT("/notes/:id", notes.Update)
-			pr.DELETE("/notes/:id", notes.Delete)
+	runner.Start()
+	errCh := make(chan error, 2)
+	go func() { errCh <- srv.Serve(ln) }()
+	slog.Info("backend listening", "addr", ln.Addr().String(), "database", cfg.databaseLabel())
+	if metricsSrv != nil {
+		go func() { errCh <- metricsSrv.Serve(metricsLn) }()
+		slog.Info("metrics listening", "addr", metricsLn.Addr().String())
+	}
 
-			pr.POST("/notes/:id/share", notes.CreateOrEnableShare)
-			pr.POST("/notes/:id/share/disable", notes.DisableShare)
-		}
+	select {
+	case err = <-errCh:
+		err = fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+		stop() // a second signal kills the process right away
+		slog.Info("shutting down", "timeout", cfg.ShutdownTimeout.String())
 	}
 
-	log.Printf("Backend listening on %s (sqlite=%s)", cfg.Addr, cfg.SQLitePath)
-	log.Fatal(r.Run(cfg.Addr))
+	// Stop accepting requests and let in-flight ones finish while the jobs
+	// wind down; both must be done before the deferred db.Close runs. A job
+	// still running after the timeout keeps the database open: closing it
+	// under a backup or purge could leave that half done, so the process
+	// exits with an error instead and the OS releases the database.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	jobsStopped := make(chan error, 1)
+	go func() { jobsStopped <- runner.Stop(shutdownCtx) }()
+	if serr := srv.Shutdown(shutdownCtx); serr != nil {
+		slog.Warn("shutdown: closing remaining connections", "error", serr)
+		srv.Close()
+	}
+	if jerr := <-jobsStopped; jerr != nil {
+		slog.Error("shutdown: background jobs still running, leaving the database open", "error", jerr)
+		keepDBOpen = true
+		err = errors.Join(err, fmt.Errorf("background jobs did not stop within %s", cfg.ShutdownTimeout))
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	// export the spans of the last requests
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if terr := shutdownTracing(flushCtx); terr != nil {
+		slog.Warn("shutdown: flushing traces", "error", terr)
+	}
+	slog.Info("stopped")
+	return err
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served on /metrics when METRICS_ENABLED is set. Event
+// counters live in the process; row counts are read from the database on
+// each scrape so they stay right across restarts and replicas.
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "greynote_http_requests_total",
+		Help: "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "greynote_http_request_duration_seconds",
+		Help:    "Time to handle an HTTP request, by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "greynote_db_query_duration_seconds",
+		Help:    "Time to run a SQL statement, by kind (exec or query).",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9), // 0.1ms to 6.5s
+	}, []string{"op"})
+
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "greynote_logins_total",
+		Help: "Login attempts by method (password, oidc) and result (success, failure, throttled).",
+	}, []string{"method", "result"})
+
+	shareLinkHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "greynote_share_link_hits_total",
+		Help: "Requests for shared notes, by result (found, not_found).",
+	}, []string{"result"})
+)
+
+// Metrics counts and times requests by route and status.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// unmatched paths and methods are client input: keep them out of
+		// the label values
+		method, route := c.Request.Method, c.FullPath()
+		if route == "" {
+			method, route = "other", "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(method, route, status).Inc()
+		httpRequestDuration.WithLabelValues(method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves the default registry. With a token, scrapers must
+// send it as "Authorization: Bearer <token>".
+func metricsHandler(token string) http.Handler {
+	h := promhttp.Handler()
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	activeSessionsDesc = prometheus.NewDesc("greynote_active_sessions", "Sessions that have not expired.", nil, nil)
+	notesDesc          = prometheus.NewDesc("greynote_notes", "Notes stored, in all workspaces.", nil, nil)
+)
+
+// dbCountsCollector reports row counts from the database at scrape time.
+type dbCountsCollector struct {
+	db *sql.DB
+}
+
+func (dbCountsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSessionsDesc
+	ch <- notesDesc
+}
+
+func (c dbCountsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := []struct {
+		desc  *prometheus.Desc
+		query string
+		args  []any
+	}{
+		{activeSessionsDesc, `SELECT COUNT(*) FROM sessions WHERE expires_at > ?`, []any{nowRFC3339()}},
+		{notesDesc, `SELECT COUNT(*) FROM notes`, nil},
+	}
+	for _, m := range counts {
+		var n int64
+		if err := c.db.QueryRow(m.query, m.args...).Scan(&n); err != nil {
+			ch <- prometheus.NewInvalidMetric(m.desc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(n))
+	}
+}
+
+// registerDBMetrics adds the row counts and db's connection pool statistics
+// to the default registry. It must be called only once.
+func registerDBMetrics(db *sql.DB) {
+	prometheus.MustRegister(dbCountsCollector{db}, collectors.NewDBStatsCollector(db, "greynote"))
+}
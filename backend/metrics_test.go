@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestMetricsNeedATokenOnThePublicPort(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.MetricsEnabled = true
+	if problems := cfg.validate(); !slices.Contains(problems, "METRICS_ENABLED without METRICS_ADDR requires METRICS_TOKEN") {
+		t.Fatalf("metrics on ADDR without a token: %v", problems)
+	}
+	cfg.MetricsAddr = ":9090"
+	if problems := cfg.validate(); len(problems) > 0 {
+		t.Fatalf("metrics on METRICS_ADDR: %v", problems)
+	}
+
+	ts := newTestServer(t, map[string]string{"METRICS_ENABLED": "true", "METRICS_TOKEN": "scrape-me"})
+	get := func(auth string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, auth := range []string{"", "Bearer wrong", "scrape-me"} {
+		if got := get(auth); got != http.StatusUnauthorized {
+			t.Fatalf("/metrics with %q: status %d", auth, got)
+		}
+	}
+	if got := get("Bearer scrape-me"); got != http.StatusOK {
+		t.Fatalf("/metrics with the token: status %d", got)
+	}
+
+	// with METRICS_ADDR the public router has no /metrics at all
+	ts = newTestServer(t, map[string]string{"METRICS_ENABLED": "true", "METRICS_ADDR": "127.0.0.1:0"})
+	if got := get("Bearer scrape-me"); got != http.StatusNotFound {
+		t.Fatalf("/metrics on ADDR with METRICS_ADDR set: status %d", got)
+	}
+}
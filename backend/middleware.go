@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"net/http"
 	"strings"
 	"time"
@@ -9,7 +8,18 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-const ginUserIDKey = "userID"
+const (
+	ginUserIDKey    = "userID"
+	ginSessionIDKey = "sessionID"
+	ginCSRFTokenKey = "csrfToken"
+	ginBearerKey    = "viaBearer"
+	// ginImpersonationKey holds the impersonations.id of an "act as user"
+	// session, or 0 for a normal one
+	ginImpersonationKey = "impersonationID"
+)
+
+// lastSeenInterval limits how often a session's last_seen_at is rewritten.
+const lastSeenInterval = time.Minute
 
 func CORSMiddleware(allowedOrigin string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -18,8 +28,9 @@ func CORSMiddleware(allowedOrigin string) gin.HandlerFunc {
 			c.Header("Access-Control-Allow-Origin", allowedOrigin)
 			c.Header("Vary", "Origin")
 			c.Header("Access-Control-Allow-Credentials", "true")
-			c.Header("Access-Control-Allow-Headers", "Content-Type")
-			c.Header("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, "+requestIDHeader+", "+csrfHeader)
+			c.Header("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+			c.Header("Access-Control-Expose-Headers", "X-Total-Count, "+requestIDHeader)
 		}
 
 		if c.Request.Method == http.MethodOptions {
@@ -31,34 +42,81 @@ func CORSMiddleware(allowedOrigin string) gin.HandlerFunc {
 	}
 }
 
-func AuthRequired(db *sql.DB, cookieName string) gin.HandlerFunc {
+// sessionToken returns the session token from an "Authorization: Bearer"
+// header or, failing that, from the session cookie.
+func sessionToken(c *gin.Context, cfg Config) (token string, viaBearer bool) {
+	if v, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(v), true
+	}
+	token, _ = c.Cookie(cfg.CookieName)
+	return strings.TrimSpace(token), false
+}
+
+func AuthRequired(store Store, cfg Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie(cookieName)
-		if err != nil || strings.TrimSpace(token) == "" {
+		ctx := c.Request.Context()
+		token, viaBearer := sessionToken(c, cfg)
+		if token == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
 
-		var userID int64
-		var expiresAt string
-		err = db.QueryRow(`SELECT user_id, expires_at FROM sessions WHERE token = ?`, token).Scan(&userID, &expiresAt)
+		sess, err := store.ActiveSession(ctx, token)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
 
-		expT, err := time.Parse(time.RFC3339, expiresAt)
-		if err != nil || time.Now().UTC().After(expT) {
-			_, _ = db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+		now := time.Now().UTC()
+		expT, err := time.Parse(time.RFC3339, sess.ExpiresAt)
+		if err != nil || now.After(expT) {
+			_ = store.DeleteSession(ctx, sess.ID)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
 
-		c.Set(ginUserIDKey, userID)
+		// slide the idle window forward, at most once per lastSeenInterval
+		if seen, err := time.Parse(time.RFC3339, sess.LastSeenAt); err != nil || now.Sub(seen) > lastSeenInterval {
+			created, err := time.Parse(time.RFC3339, sess.CreatedAt)
+			if err != nil {
+				created = now
+			}
+			newExp := sessionExpiry(cfg, created, now)
+			if sess.ImpersonationID != 0 {
+				// impersonation sessions have a fixed end
+				newExp = expT
+			}
+			err = store.TouchSession(ctx, sess.ID, now.Format(time.RFC3339), c.ClientIP(), newExp.Format(time.RFC3339))
+			if err == nil && !viaBearer {
+				setSessionCookie(c, cfg, token, newExp.Sub(now))
+			}
+		}
+
+		// sessions created before CSRF tokens existed get one on first use
+		if sess.CSRFToken == "" {
+			if sess.CSRFToken, err = randomTokenURLSafe(32); err != nil {
+				internalError(c, "token error", err)
+				c.Abort()
+				return
+			}
+			_ = store.SetSessionCSRFToken(ctx, sess.ID, sess.CSRFToken)
+		}
+
+		c.Set(ginUserIDKey, sess.UserID)
+		c.Set(ginSessionIDKey, sess.ID)
+		c.Set(ginCSRFTokenKey, sess.CSRFToken)
+		c.Set(ginBearerKey, viaBearer)
+		c.Set(ginImpersonationKey, sess.ImpersonationID)
 		c.Next()
 	}
 }
 
+func setSessionCookie(c *gin.Context, cfg Config, token string, ttl time.Duration) {
+	// Gin cookie: maxAge in seconds
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(cfg.CookieName, token, int(ttl.Seconds()), "/", "", cfg.CookieSecure, true)
+}
+
 func getUserID(c *gin.Context) int64 {
 	v, ok := c.Get(ginUserIDKey)
 	if !ok {
@@ -66,3 +124,11 @@ func getUserID(c *gin.Context) int64 {
 	}
 	return v.(int64)
 }
+
+func getSessionID(c *gin.Context) int64 {
+	v, ok := c.Get(ginSessionIDKey)
+	if !ok {
+		return 0
+	}
+	return v.(int64)
+}
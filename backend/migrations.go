@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Schema changes live in migrations/<dialect>/ as NNNN_name.up.sql with an
+// optional NNNN_name.down.sql; every dialect has the same versions. Applied
+// versions are recorded in schema_migrations together with a checksum of
+// the up script, so editing a migration that has already run is caught
+// instead of silently diverging.
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d{4})_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string // empty when the migration cannot be reverted
+	Checksum string
+}
+
+type appliedMigration struct {
+	Version   int
+	Checksum  string
+	AppliedAt string
+}
+
+func loadMigrations(d dialect) ([]migration, error) {
+	dir := "migrations/" + string(d)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		b, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mg := byVersion[version]
+		if mg == nil {
+			mg = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mg
+		} else if mg.Name != m[2] {
+			return nil, fmt.Errorf("migrations: version %04d used by both %s and %s", version, mg.Name, m[2])
+		}
+		if m[3] == "up" {
+			mg.Up = string(b)
+			sum := sha256.Sum256(b)
+			mg.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mg.Down = string(b)
+		}
+	}
+
+	out := make([]migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("migrations: %04d_%s has no up script", mg.Version, mg.Name)
+		}
+		out = append(out, *mg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+func appliedMigrations(db *sql.DB) (map[int]appliedMigration, error) {
+	rows, err := db.Query(`SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		out[a.Version] = a
+	}
+	return out, rows.Err()
+}
+
+// verifyMigrations fails if an applied migration was edited afterwards or is
+// unknown to this binary (i.e. the database was migrated by a newer build).
+func verifyMigrations(all []migration, applied map[int]appliedMigration) error {
+	known := map[int]bool{}
+	for _, m := range all {
+		known[m.Version] = true
+		if a, ok := applied[m.Version]; ok && a.Checksum != m.Checksum {
+			return fmt.Errorf("migration %04d_%s was modified after it was applied (checksum mismatch)", m.Version, m.Name)
+		}
+	}
+	for v := range applied {
+		if !known[v] {
+			return fmt.Errorf("database has migration %04d applied, which this build does not know; upgrade the binary", v)
+		}
+	}
+	return nil
+}
+
+// baselineLegacySchema prepares a database created before schema_migrations
+// existed. It adds the columns the old migrate() bolted on over time so that
+// migration 0001, whose statements are all IF NOT EXISTS, can then be
+// applied on top of it like on a fresh database.
+func baselineLegacySchema(db *sql.DB) error {
+	if dialectOf(db) != dialectSQLite {
+		return nil // postgres support came with versioned migrations
+	}
+	exists, err := tableExists(db, "users")
+	if err != nil || !exists {
+		return err // !exists: fresh database
+	}
+
+	cols := []struct{ table, column, ddl string }{
+		{"sessions", "user_agent", `ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''`},
+		{"sessions", "ip", `ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT ''`},
+		{"sessions", "last_seen_at", `ALTER TABLE sessions ADD COLUMN last_seen_at TEXT NOT NULL DEFAULT ''`},
+		{"users", "oidc_subject", `ALTER TABLE users ADD COLUMN oidc_subject TEXT`},
+		{"sessions", "csrf_token", `ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT ''`},
+		{"users", "suspended_at", `ALTER TABLE users ADD COLUMN suspended_at TEXT NOT NULL DEFAULT ''`},
+		{"users", "delete_after", `ALTER TABLE users ADD COLUMN delete_after TEXT NOT NULL DEFAULT ''`},
+		{"users", "last_login_at", `ALTER TABLE users ADD COLUMN last_login_at TEXT NOT NULL DEFAULT ''`},
+		{"sessions", "impersonation_id", `ALTER TABLE sessions ADD COLUMN impersonation_id INTEGER NOT NULL DEFAULT 0`},
+		{"notes", "workspace_id", `ALTER TABLE notes ADD COLUMN workspace_id INTEGER NOT NULL DEFAULT 0`},
+		{"users", "display_name", `ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`},
+		{"users", "timezone", `ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`},
+		{"users", "locale", `ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT ''`},
+		{"users", "preferences", `ALTER TABLE users ADD COLUMN preferences TEXT NOT NULL DEFAULT '{}'`},
+	}
+	for _, col := range cols {
+		if err := ensureColumn(db, col.table, col.column, col.ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUp applies pending migrations up to and including target (0 means
+// all of them), each in its own transaction. It returns the versions applied.
+func migrateUp(db *sql.DB, target int) ([]int, error) {
+	all, err := loadMigrations(dialectOf(db))
+	if err != nil {
+		return nil, err
+	}
+
+	hasTable, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !hasTable {
+		if err := baselineLegacySchema(db); err != nil {
+			return nil, fmt.Errorf("baseline legacy schema: %w", err)
+		}
+		if err := ensureMigrationsTable(db); err != nil {
+			return nil, err
+		}
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(all, applied); err != nil {
+		return nil, err
+	}
+
+	var done []int
+	for _, m := range all {
+		if target != 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(db, m.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				`INSERT INTO schema_migrations(version, name, checksum, applied_at) VALUES(?,?,?,?)`,
+				m.Version, m.Name, m.Checksum, nowRFC3339(),
+			)
+			return err
+		}); err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the newest steps applied migrations. It returns the
+// versions reverted.
+func migrateDown(db *sql.DB, steps int) ([]int, error) {
+	all, err := loadMigrations(dialectOf(db))
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(all, applied); err != nil {
+		return nil, err
+	}
+
+	var done []int
+	for i := len(all) - 1; i >= 0 && len(done) < steps; i-- {
+		m := all[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("migration %04d_%s cannot be reverted (no down script)", m.Version, m.Name)
+		}
+		if err := applyMigration(db, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+			return err
+		}); err != nil {
+			return done, fmt.Errorf("revert %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// applyMigration runs script and record in one transaction. Both drivers
+// execute every statement of a multi-statement Exec without arguments.
+func applyMigration(db *sql.DB, script string, record func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func printMigrationStatus(db *sql.DB, w io.Writer) error {
+	all, err := loadMigrations(dialectOf(db))
+	if err != nil {
+		return err
+	}
+	// a database that was never migrated has every migration pending; the
+	// table is not created here, so status stays read-only
+	applied := map[int]appliedMigration{}
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if exists {
+		if applied, err = appliedMigrations(db); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, m := range all {
+		a, ok := applied[m.Version]
+		switch {
+		case !ok:
+			fmt.Fprintf(tw, "%04d\t%s\tpending\t\n", m.Version, m.Name)
+		case a.Checksum != m.Checksum:
+			fmt.Fprintf(tw, "%04d\t%s\tMODIFIED\t%s\n", m.Version, m.Name, a.AppliedAt)
+		default:
+			fmt.Fprintf(tw, "%04d\t%s\tapplied\t%s\n", m.Version, m.Name, a.AppliedAt)
+		}
+		delete(applied, m.Version)
+	}
+	for v, a := range applied {
+		fmt.Fprintf(tw, "%04d\t?\tUNKNOWN\t%s\n", v, a.AppliedAt)
+	}
+	return tw.Flush()
+}
+
+// runMigrateCommand implements `greynote migrate up [version] | down [steps] | status`.
+func runMigrateCommand(cfg Config, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: migrate up [version] | down [steps] | status")
+	}
+	n := 0
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return fmt.Errorf("migrate %s: expected a positive number, got %q", args[0], args[1])
+		}
+	}
+
+	connect := connectDB
+	if args[0] == "status" {
+		connect = connectExistingDB
+	}
+	db, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := migrateUp(db, n)
+		for _, v := range done {
+			fmt.Printf("applied %04d\n", v)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("already up to date")
+		}
+		return err
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		done, err := migrateDown(db, n)
+		for _, v := range done {
+			fmt.Printf("reverted %04d\n", v)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to revert")
+		}
+		return err
+	case "status":
+		if len(args) > 1 {
+			return errors.New("usage: migrate status")
+		}
+		return printMigrationStatus(db, os.Stdout)
+	default:
+		return fmt.Errorf("migrate: unknown command %q", args[0])
+	}
+}
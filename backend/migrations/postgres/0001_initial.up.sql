@@ -0,0 +1,175 @@
+-- PostgreSQL counterpart of sqlite/0001_initial.up.sql. Timestamps stay RFC
+-- 3339 text so both databases sort and compare them the same way.
+
+CREATE TABLE users (
+	id BIGSERIAL PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	is_admin INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL,
+	oidc_subject TEXT,
+	suspended_at TEXT NOT NULL DEFAULT '',
+	delete_after TEXT NOT NULL DEFAULT '',
+	last_login_at TEXT NOT NULL DEFAULT '',
+	display_name TEXT NOT NULL DEFAULT '',
+	timezone TEXT NOT NULL DEFAULT '',
+	locale TEXT NOT NULL DEFAULT '',
+	preferences TEXT NOT NULL DEFAULT '{}'
+);
+CREATE UNIQUE INDEX users_oidc_subject ON users(oidc_subject) WHERE oidc_subject IS NOT NULL;
+
+CREATE TABLE sessions (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token TEXT NOT NULL UNIQUE,
+	expires_at TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	last_seen_at TEXT NOT NULL DEFAULT '',
+	csrf_token TEXT NOT NULL DEFAULT '',
+	impersonation_id BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX sessions_user ON sessions(user_id);
+
+CREATE TABLE workspaces (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	personal_user_id BIGINT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE workspace_members (
+	workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY(workspace_id, user_id)
+);
+
+CREATE TABLE workspace_invitations (
+	id BIGSERIAL PRIMARY KEY,
+	workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	invited_by BIGINT NOT NULL,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+);
+
+CREATE TABLE notes (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	title TEXT NOT NULL,
+	content TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	workspace_id BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX notes_workspace ON notes(workspace_id, updated_at);
+
+CREATE TABLE share_links (
+	id BIGSERIAL PRIMARY KEY,
+	note_id BIGINT NOT NULL UNIQUE REFERENCES notes(id) ON DELETE CASCADE,
+	token TEXT NOT NULL UNIQUE,
+	is_enabled INTEGER NOT NULL DEFAULT 1,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE login_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE login_lockouts (
+	id BIGSERIAL PRIMARY KEY,
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	locked_until TEXT NOT NULL DEFAULT '',
+	last_failure_at TEXT NOT NULL,
+	UNIQUE(kind, value)
+);
+
+CREATE TABLE roles (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT '',
+	builtin INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE role_permissions (
+	role_id BIGINT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission TEXT NOT NULL,
+	PRIMARY KEY(role_id, permission)
+);
+
+CREATE TABLE user_roles (
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id BIGINT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id, role_id)
+);
+
+CREATE TABLE password_resets (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE,
+	expires_at TEXT NOT NULL,
+	created_by BIGINT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE impersonations (
+	id BIGSERIAL PRIMARY KEY,
+	admin_id BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	admin_session_id BIGINT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL,
+	started_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL,
+	ended_at TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	actor_id BIGINT NOT NULL,
+	actor_email TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	details TEXT NOT NULL
+);
+CREATE INDEX audit_log_created_at ON audit_log(created_at);
+-- the audit log is append-only
+CREATE FUNCTION audit_log_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$;
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE avatars (
+	user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	content_type TEXT NOT NULL,
+	data BYTEA NOT NULL,
+	updated_at TEXT NOT NULL
+);
+
+CREATE TABLE oidc_states (
+	state TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
@@ -0,0 +1,19 @@
+-- Drops everything; children before parents so foreign keys never dangle.
+
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS avatars;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS impersonations;
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS login_lockouts;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS share_links;
+DROP TABLE IF EXISTS notes;
+DROP TABLE IF EXISTS workspace_invitations;
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
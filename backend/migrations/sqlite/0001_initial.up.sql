@@ -0,0 +1,180 @@
+-- The schema as it stood before versioned migrations. Every statement is
+-- IF NOT EXISTS so databases created by the old ad-hoc migrate() can be
+-- baselined onto it.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	is_admin INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL,
+	oidc_subject TEXT,
+	suspended_at TEXT NOT NULL DEFAULT '',
+	delete_after TEXT NOT NULL DEFAULT '',
+	last_login_at TEXT NOT NULL DEFAULT '',
+	display_name TEXT NOT NULL DEFAULT '',
+	timezone TEXT NOT NULL DEFAULT '',
+	locale TEXT NOT NULL DEFAULT '',
+	preferences TEXT NOT NULL DEFAULT '{}'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_subject ON users(oidc_subject) WHERE oidc_subject IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	token TEXT NOT NULL UNIQUE,
+	expires_at TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	last_seen_at TEXT NOT NULL DEFAULT '',
+	csrf_token TEXT NOT NULL DEFAULT '',
+	impersonation_id INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS workspaces (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	personal_user_id INTEGER UNIQUE,
+	created_at TEXT NOT NULL,
+	FOREIGN KEY(personal_user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS workspace_members (
+	workspace_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	role TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY(workspace_id, user_id),
+	FOREIGN KEY(workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS workspace_invitations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	workspace_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	invited_by INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL,
+	FOREIGN KEY(workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	content TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	workspace_id INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS notes_workspace ON notes(workspace_id, updated_at);
+
+CREATE TABLE IF NOT EXISTS share_links (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	note_id INTEGER NOT NULL UNIQUE,
+	token TEXT NOT NULL UNIQUE,
+	is_enabled INTEGER NOT NULL DEFAULT 1,
+	created_at TEXT NOT NULL,
+	FOREIGN KEY(note_id) REFERENCES notes(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	locked_until TEXT NOT NULL DEFAULT '',
+	last_failure_at TEXT NOT NULL,
+	UNIQUE(kind, value)
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT '',
+	builtin INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id INTEGER NOT NULL,
+	permission TEXT NOT NULL,
+	PRIMARY KEY(role_id, permission),
+	FOREIGN KEY(role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id INTEGER NOT NULL,
+	role_id INTEGER NOT NULL,
+	PRIMARY KEY(user_id, role_id),
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	expires_at TEXT NOT NULL,
+	created_by INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS impersonations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	admin_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	admin_session_id INTEGER NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL,
+	started_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL,
+	ended_at TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor_id INTEGER NOT NULL,
+	actor_email TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	details TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log(created_at);
+-- the audit log is append-only
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+
+CREATE TABLE IF NOT EXISTS avatars (
+	user_id INTEGER PRIMARY KEY,
+	content_type TEXT NOT NULL,
+	data BLOB NOT NULL,
+	updated_at TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+	state TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
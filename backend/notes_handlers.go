@@ -1,52 +1,163 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type NotesHandlers struct {
-	DB *sql.DB
+	Store Store
 }
 
-func NewNotesHandlers(db *sql.DB) *NotesHandlers {
-	return &NotesHandlers{DB: db}
+func NewNotesHandlers(store Store) *NotesHandlers {
+	return &NotesHandlers{Store: store}
 }
 
 type noteDTO struct {
-	ID        int64  `json:"id"`
+	ID          int64  `json:"id"`
+	WorkspaceID int64  `json:"workspaceId"`
+	Title       string `json:"title"`
+	Content     string `json:"content"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+	ShareURL    string `json:"shareUrl,omitempty"`
+	// Role is the caller's role in the note's workspace (single-note reads only).
+	Role string `json:"role,omitempty"`
+}
+
+func newNoteDTO(n Note) noteDTO {
+	return noteDTO{
+		ID:          n.ID,
+		WorkspaceID: n.WorkspaceID,
+		Title:       n.Title,
+		Content:     n.Content,
+		CreatedAt:   n.CreatedAt,
+		UpdatedAt:   n.UpdatedAt,
+	}
+}
+
+// sharedNoteDTO is what a share link shows to anyone holding it: no IDs
+// that would reveal the author's workspace or how many notes exist.
+type sharedNoteDTO struct {
 	Title     string `json:"title"`
 	Content   string `json:"content"`
 	CreatedAt string `json:"createdAt"`
 	UpdatedAt string `json:"updatedAt"`
-	ShareURL  string `json:"shareUrl,omitempty"`
 }
 
 type noteUpsertReq struct {
 	Title   string `json:"title"`
 	Content string `json:"content"`
+	// WorkspaceID picks the workspace on create; 0 means the personal one.
+	WorkspaceID int64 `json:"workspaceId"`
 }
 
-func (h *NotesHandlers) List(c *gin.Context) {
+// workspaceAccess resolves the workspace a list or create request targets,
+// defaulting to the caller's personal one, and checks the caller holds at
+// least min in it. It writes the error response itself and returns 0 then.
+func (h *NotesHandlers) workspaceAccess(c *gin.Context, wsID int64, min string) int64 {
+	ctx := c.Request.Context()
 	userID := getUserID(c)
+	if wsID == 0 {
+		id, err := h.Store.PersonalWorkspace(ctx, userID)
+		if err != nil {
+			internalError(c, "db error", err)
+			return 0
+		}
+		return id
+	}
 
-	rows, err := h.DB.Query(`SELECT id, title, content, created_at, updated_at FROM notes WHERE user_id = ? ORDER BY updated_at DESC`, userID)
+	role, err := h.Store.WorkspaceRole(ctx, wsID, userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-		return
+		internalError(c, "db error", err)
+		return 0
+	}
+	if role == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "workspace not found"})
+		return 0
 	}
-	defer rows.Close()
+	if !wsRoleAtLeast(role, min) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "read-only access"})
+		return 0
+	}
+	return wsID
+}
 
-	out := []noteDTO{}
-	for rows.Next() {
-		var n noteDTO
-		if err := rows.Scan(&n.ID, &n.Title, &n.Content, &n.CreatedAt, &n.UpdatedAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-			return
+// noteAccess parses :id and checks the caller holds at least min in the
+// note's workspace. Notes outside the caller's workspaces are reported as
+// not found. It writes the error response itself and returns 0 then.
+func (h *NotesHandlers) noteAccess(c *gin.Context, min string) (int64, string) {
+	ctx := c.Request.Context()
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+	role, err := h.Store.NoteRole(ctx, id, getUserID(c))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return 0, ""
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return 0, ""
+	}
+	if !wsRoleAtLeast(role, min) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "read-only access"})
+		return 0, ""
+	}
+	return id, role
+}
+
+// timeLocation returns the zone note timestamps are rendered in: the
+// caller's profile time zone with ?tz=local, otherwise UTC as stored. It
+// writes the error response and returns nil on failure.
+func (h *NotesHandlers) timeLocation(c *gin.Context) *time.Location {
+	ctx := c.Request.Context()
+	switch c.Query("tz") {
+	case "", "utc":
+		return time.UTC
+	case "local":
+		loc, err := userLocation(ctx, h.Store, getUserID(c))
+		if err != nil {
+			internalError(c, "bad profile time zone", err)
+			return nil
 		}
+		return loc
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be utc or local"})
+		return nil
+	}
+}
+
+func (n *noteDTO) localize(loc *time.Location) {
+	n.CreatedAt = inLocation(n.CreatedAt, loc)
+	n.UpdatedAt = inLocation(n.UpdatedAt, loc)
+}
+
+// GET /api/notes?workspace=&tz=
+func (h *NotesHandlers) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	wsID, _ := strconv.ParseInt(c.Query("workspace"), 10, 64)
+	if wsID = h.workspaceAccess(c, wsID, wsRoleViewer); wsID == 0 {
+		return
+	}
+	loc := h.timeLocation(c)
+	if loc == nil {
+		return
+	}
+
+	notes, err := h.Store.ListNotes(ctx, wsID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	out := make([]noteDTO, 0, len(notes))
+	for _, note := range notes {
+		n := newNoteDTO(note)
+		n.localize(loc)
 		out = append(out, n)
 	}
 
@@ -54,6 +165,7 @@ func (h *NotesHandlers) List(c *gin.Context) {
 }
 
 func (h *NotesHandlers) Create(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID := getUserID(c)
 
 	var req noteUpsertReq
@@ -61,49 +173,65 @@ func (h *NotesHandlers) Create(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
 		return
 	}
+	wsID := h.workspaceAccess(c, req.WorkspaceID, wsRoleEditor)
+	if wsID == 0 {
+		return
+	}
 
 	now := nowRFC3339()
-	res, err := h.DB.Exec(
-		`INSERT INTO notes(user_id, title, content, created_at, updated_at) VALUES(?,?,?,?,?)`,
-		userID, req.Title, req.Content, now, now,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	note := Note{UserID: userID, WorkspaceID: wsID, Title: req.Title, Content: req.Content, CreatedAt: now, UpdatedAt: now}
+	if err := h.Store.CreateNote(ctx, &note); err != nil {
+		internalError(c, "db error", err)
 		return
 	}
-	id, _ := res.LastInsertId()
 
-	c.JSON(http.StatusCreated, gin.H{"id": id})
+	c.JSON(http.StatusCreated, gin.H{"id": note.ID})
 }
 
+// GET /api/notes/:id?tz=
 func (h *NotesHandlers) Get(c *gin.Context) {
-	userID := getUserID(c)
-	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	ctx := c.Request.Context()
+	id, role := h.noteAccess(c, wsRoleViewer)
+	if id == 0 {
+		return
+	}
+	loc := h.timeLocation(c)
+	if loc == nil {
+		return
+	}
 
-	var n noteDTO
-	err := h.DB.QueryRow(
-		`SELECT id, title, content, created_at, updated_at FROM notes WHERE id = ? AND user_id = ?`,
-		id, userID,
-	).Scan(&n.ID, &n.Title, &n.Content, &n.CreatedAt, &n.UpdatedAt)
-	if err != nil {
+	note, err := h.Store.Note(ctx, id)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	n := newNoteDTO(note)
+	n.Role = role
+	n.localize(loc)
 
 	// include share URL if enabled
-	var token string
-	var enabled int
-	err = h.DB.QueryRow(`SELECT token, is_enabled FROM share_links WHERE note_id = ?`, n.ID).Scan(&token, &enabled)
-	if err == nil && enabled == 1 {
-		n.ShareURL = "/share/" + token
+	link, err := h.Store.ShareLink(ctx, n.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		internalError(c, "db error", err)
+		return
+	}
+	if err == nil && link.Enabled {
+		n.ShareURL = "/share/" + link.Token
 	}
 
 	c.JSON(http.StatusOK, n)
 }
 
 func (h *NotesHandlers) Update(c *gin.Context) {
-	userID := getUserID(c)
-	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	ctx := c.Request.Context()
+	id, _ := h.noteAccess(c, wsRoleEditor)
+	if id == 0 {
+		return
+	}
 
 	var req noteUpsertReq
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -111,16 +239,12 @@ func (h *NotesHandlers) Update(c *gin.Context) {
 		return
 	}
 
-	res, err := h.DB.Exec(
-		`UPDATE notes SET title = ?, content = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
-		req.Title, req.Content, nowRFC3339(), id, userID,
-	)
+	found, err := h.Store.UpdateNote(ctx, id, req.Title, req.Content, nowRFC3339())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		internalError(c, "db error", err)
 		return
 	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
+	if !found {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
@@ -129,16 +253,18 @@ func (h *NotesHandlers) Update(c *gin.Context) {
 }
 
 func (h *NotesHandlers) Delete(c *gin.Context) {
-	userID := getUserID(c)
-	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	ctx := c.Request.Context()
+	id, _ := h.noteAccess(c, wsRoleEditor)
+	if id == 0 {
+		return
+	}
 
-	res, err := h.DB.Exec(`DELETE FROM notes WHERE id = ? AND user_id = ?`, id, userID)
+	found, err := h.Store.DeleteNote(ctx, id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		internalError(c, "db error", err)
 		return
 	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
+	if !found {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
@@ -148,77 +274,72 @@ func (h *NotesHandlers) Delete(c *gin.Context) {
 
 // POST /api/notes/:id/share
 func (h *NotesHandlers) CreateOrEnableShare(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID := getUserID(c)
-	noteID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
-
-	// verify ownership
-	var dummy int64
-	if err := h.DB.QueryRow(`SELECT id FROM notes WHERE id = ? AND user_id = ?`, noteID, userID).Scan(&dummy); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	noteID, _ := h.noteAccess(c, wsRoleEditor)
+	if noteID == 0 {
 		return
 	}
 
-	// existing link?
-	var token string
-	err := h.DB.QueryRow(`SELECT token FROM share_links WHERE note_id = ?`, noteID).Scan(&token)
-	if err == nil {
-		_, _ = h.DB.Exec(`UPDATE share_links SET is_enabled = 1 WHERE note_id = ?`, noteID)
-	} else {
-		token, err = randomTokenURLSafe(24)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "token error"})
-			return
-		}
-		_, err = h.DB.Exec(
-			`INSERT INTO share_links(note_id, token, is_enabled, created_at) VALUES(?,?,1,?)`,
-			noteID, token, nowRFC3339(),
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-			return
-		}
+	// only used if the note has no link yet; an existing one keeps its token
+	token, err := randomTokenURLSafe(24)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+	link, err := h.Store.EnableShareLink(ctx, noteID, token, nowRFC3339())
+	if err != nil {
+		internalError(c, "db error", err)
+		return
 	}
 
+	writeAudit(h.Store, c, userID, auditShareEnable, auditTarget("note", noteID), nil)
+
 	c.JSON(http.StatusOK, gin.H{
-		"token":    token,
-		"shareUrl": "/share/" + token,
+		"token":    link.Token,
+		"shareUrl": "/share/" + link.Token,
 	})
 }
 
 // POST /api/notes/:id/share/disable
 func (h *NotesHandlers) DisableShare(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID := getUserID(c)
-	noteID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
-
-	var dummy int64
-	if err := h.DB.QueryRow(`SELECT id FROM notes WHERE id = ? AND user_id = ?`, noteID, userID).Scan(&dummy); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	noteID, _ := h.noteAccess(c, wsRoleEditor)
+	if noteID == 0 {
 		return
 	}
 
-	_, _ = h.DB.Exec(`UPDATE share_links SET is_enabled = 0 WHERE note_id = ?`, noteID)
+	if err := h.Store.DisableShareLink(ctx, noteID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, userID, auditShareDisable, auditTarget("note", noteID), nil)
 	c.Status(http.StatusNoContent)
 }
 
 // GET /api/share/:token (public)
 func (h *NotesHandlers) GetShared(c *gin.Context) {
+	ctx := c.Request.Context()
 	token := c.Param("token")
 
-	var noteID int64
-	var enabled int
-	err := h.DB.QueryRow(`SELECT note_id, is_enabled FROM share_links WHERE token = ?`, token).Scan(&noteID, &enabled)
-	if err != nil || enabled != 1 {
+	// links of suspended users stay dark until they are reactivated
+	note, err := h.Store.SharedNote(ctx, token)
+	if errors.Is(err, ErrNotFound) {
+		shareLinkHits.WithLabelValues("not_found").Inc()
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
-
-	var n noteDTO
-	err = h.DB.QueryRow(`SELECT id, title, content, created_at, updated_at FROM notes WHERE id = ?`, noteID).
-		Scan(&n.ID, &n.Title, &n.Content, &n.CreatedAt, &n.UpdatedAt)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		internalError(c, "db error", err)
 		return
 	}
+	shareLinkHits.WithLabelValues("found").Inc()
 
-	c.JSON(http.StatusOK, n)
+	c.JSON(http.StatusOK, sharedNoteDTO{
+		Title:     note.Title,
+		Content:   note.Content,
+		CreatedAt: note.CreatedAt,
+		UpdatedAt: note.UpdatedAt,
+	})
 }
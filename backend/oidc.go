@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateTTL bounds how long a user may take at the identity provider.
+const oidcStateTTL = 10 * time.Minute
+
+// Reasons provisionUser turns a valid ID token away. Their text is shown on
+// the login page; any other error is reported there only as
+// "account could not be linked".
+var (
+	errOIDCNoEmail          = errors.New("identity provider did not supply an email")
+	errOIDCEmailNotVerified = errors.New("email not verified")
+)
+
+// OIDCHandlers implements the authorization-code + PKCE login flow against
+// the configured OpenID Connect provider.
+type OIDCHandlers struct {
+	Store Store
+	Cfg   Config
+	Auth  *AuthHandlers
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOIDCHandlers(store Store, cfg Config, auth *AuthHandlers) *OIDCHandlers {
+	return &OIDCHandlers{Store: store, Cfg: cfg, Auth: auth}
+}
+
+// client runs discovery on first use, so the server can start while the
+// identity provider is unreachable; a failed discovery is retried next time.
+func (h *OIDCHandlers) client(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.oauth != nil {
+		return h.oauth, h.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, h.Cfg.OIDCIssuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.oauth = &oauth2.Config{
+		ClientID:     h.Cfg.OIDCClientID,
+		ClientSecret: h.Cfg.OIDCClientSecret,
+		RedirectURL:  h.Cfg.OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       h.Cfg.OIDCScopes,
+	}
+	h.verifier = provider.Verifier(&oidc.Config{ClientID: h.Cfg.OIDCClientID})
+	return h.oauth, h.verifier, nil
+}
+
+func (h *OIDCHandlers) stateCookieName() string {
+	return h.Cfg.CookieName + "_oidc"
+}
+
+// GET /api/oidc/login
+func (h *OIDCHandlers) Login(c *gin.Context) {
+	ctx := c.Request.Context()
+	oc, _, err := h.client(c.Request.Context())
+	if err != nil {
+		requestLogger(c).Warn("oidc discovery", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+
+	state, err := randomTokenURLSafe(24)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+	nonce, err := randomTokenURLSafe(24)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = h.Store.SaveOIDCState(ctx, OIDCState{State: state, Nonce: nonce, CodeVerifier: verifier, CreatedAt: nowRFC3339()})
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	// binds the callback to this browser
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(h.stateCookieName(), state, int(oidcStateTTL.Seconds()), "/", "", h.Cfg.CookieSecure, true)
+
+	c.Redirect(http.StatusFound, oc.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)))
+}
+
+// GET /api/oidc/callback
+func (h *OIDCHandlers) Callback(c *gin.Context) {
+	ctx := c.Request.Context()
+	fail := func(msg string) {
+		logins.WithLabelValues("oidc", "failure").Inc()
+		c.Redirect(http.StatusFound, h.frontendURL("/login?sso_error="+url.QueryEscape(msg)))
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(h.stateCookieName(), "", -1, "/", "", h.Cfg.CookieSecure, true)
+
+	if e := c.Query("error"); e != "" {
+		requestLogger(c).Info("oidc login refused", "error", e, "description", c.Query("error_description"))
+		fail("sign-in was cancelled or refused")
+		return
+	}
+
+	state := c.Query("state")
+	cookieState, err := c.Cookie(h.stateCookieName())
+	if err != nil || state == "" || cookieState != state {
+		fail("state mismatch")
+		return
+	}
+
+	nonce, verifier, err := h.takeState(ctx, state)
+	if err != nil {
+		fail("login expired, try again")
+		return
+	}
+
+	oc, idv, err := h.client(ctx)
+	if err != nil {
+		requestLogger(c).Warn("oidc discovery", "error", err)
+		fail("identity provider unavailable")
+		return
+	}
+
+	tok, err := oc.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		requestLogger(c).Warn("oidc exchange", "error", err)
+		fail("code exchange failed")
+		return
+	}
+	rawID, ok := tok.Extra("id_token").(string)
+	if !ok {
+		fail("no id token")
+		return
+	}
+	idt, err := idv.Verify(ctx, rawID)
+	if err != nil || idt.Nonce != nonce {
+		requestLogger(c).Warn("oidc verify", "error", err)
+		fail("invalid id token")
+		return
+	}
+
+	var claims map[string]any
+	if err := idt.Claims(&claims); err != nil {
+		fail("invalid id token")
+		return
+	}
+
+	userID, err := h.provisionUser(ctx, idt.Subject, claims)
+	switch {
+	case errors.Is(err, errOIDCNoEmail), errors.Is(err, errOIDCEmailNotVerified):
+		requestLogger(c).Info("oidc provision", "subject", idt.Subject, "error", err)
+		fail(err.Error())
+		return
+	case err != nil:
+		requestLogger(c).Error("oidc provision", "subject", idt.Subject, "error", err)
+		fail("account could not be linked")
+		return
+	}
+
+	if err := h.Auth.startSession(c, userID); errors.Is(err, ErrAccountSuspended) {
+		fail("account suspended")
+		return
+	} else if err != nil {
+		requestLogger(c).Error("oidc session", "user_id", userID, "error", err)
+		fail("session error")
+		return
+	}
+	writeAudit(h.Store, c, userID, auditLoginSuccess, auditTarget("user", userID), gin.H{"method": "oidc"})
+	logins.WithLabelValues("oidc", "success").Inc()
+
+	c.Redirect(http.StatusFound, h.frontendURL("/"))
+}
+
+// frontendURL returns path on the web frontend, which need not be served
+// from the backend's origin.
+func (h *OIDCHandlers) frontendURL(path string) string {
+	return strings.TrimRight(h.Cfg.FrontendOrigin, "/") + path
+}
+
+// takeState consumes a pending login and returns its nonce and PKCE verifier.
+func (h *OIDCHandlers) takeState(ctx context.Context, state string) (string, string, error) {
+	cutoff := time.Now().UTC().Add(-oidcStateTTL).Format(time.RFC3339)
+	st, err := h.Store.TakeOIDCState(ctx, state, cutoff)
+	if err != nil {
+		return "", "", err
+	}
+	return st.Nonce, st.CodeVerifier, nil
+}
+
+// provisionUser finds the local user for an OIDC subject, linking an
+// existing account when the provider marks its email as verified or
+// creating one on first login.
+func (h *OIDCHandlers) provisionUser(ctx context.Context, subject string, claims map[string]any) (int64, error) {
+	email, _ := claims["email"].(string)
+	email = strings.TrimSpace(strings.ToLower(email))
+	verified, hasVerified := claims["email_verified"].(bool)
+
+	u, err := h.Store.UserByOIDCSubject(ctx, subject)
+	switch {
+	case err == nil:
+	case !errors.Is(err, ErrNotFound):
+		return 0, err
+	case email == "":
+		return 0, errOIDCNoEmail
+	case hasVerified && !verified:
+		return 0, errOIDCEmailNotVerified
+	default:
+		u, err = h.Store.UserByEmail(ctx, email)
+		if err == nil {
+			// linking hands the account to whoever holds this subject, so
+			// the provider has to vouch for the address
+			if !verified {
+				return 0, errOIDCEmailNotVerified
+			}
+			if err := h.Store.SetOIDCSubject(ctx, u.ID, subject); err != nil {
+				return 0, err
+			}
+			break
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+
+		// SSO-only accounts get an empty hash, which never matches a password
+		u = User{Email: email, OIDCSubject: subject, CreatedAt: nowRFC3339()}
+		if err := h.Store.CreateUser(ctx, &u, ""); err != nil {
+			return 0, err
+		}
+	}
+	userID := u.ID
+
+	if h.Cfg.OIDCAdminGroup != "" {
+		isAdmin := claimHas(claims[h.Cfg.OIDCGroupsClaim], h.Cfg.OIDCAdminGroup)
+		if err := h.Store.SetSuperuser(ctx, userID, isAdmin); err != nil {
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// claimHas reports whether a string or string-array claim contains want.
+func claimHas(claim any, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientID     = "greynote"
+	mockClientSecret = "s3cret"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, JWKS and a token
+// endpoint that enforces PKCE. There is no login page; authorize stands in
+// for the user approving the request.
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := idp.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]any{{
+		"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+		"n": b64(pub.N.Bytes()),
+		"e": b64(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != mockClientID || secret != mockClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || b64(sum[:]) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"aud":   mockClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.sign(claims),
+	})
+}
+
+func (idp *mockIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	input := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return input + "." + b64(sig)
+}
+
+// authorize approves the authorization request the server redirected to and
+// returns the code and state to hand back to the callback. The ID token
+// issued for the code carries claims.
+func (idp *mockIdP) authorize(location string, claims map[string]any) (code, state string) {
+	idp.t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, idp.URL+"/authorize?") {
+		idp.t.Fatalf("login redirected to %q, want the IdP's authorization endpoint", location)
+	}
+	q := u.Query()
+	if q.Get("client_id") != mockClientID || q.Get("response_type") != "code" {
+		idp.t.Fatalf("bad authorization request: %s", u.RawQuery)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		idp.t.Fatalf("authorization request without PKCE: %s", u.RawQuery)
+	}
+
+	code = b64([]byte(q.Get("state") + "-code"))
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	idp.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func newOIDCTestServer(t *testing.T) (*testServer, *mockIdP) {
+	idp := newMockIdP(t)
+	ts := newTestServer(t, map[string]string{
+		"OIDC_ISSUER":        idp.URL,
+		"OIDC_CLIENT_ID":     mockClientID,
+		"OIDC_CLIENT_SECRET": mockClientSecret,
+		"OIDC_REDIRECT_URL":  "http://greynote.test/api/oidc/callback",
+		"FRONTEND_ORIGIN":    oidcTestFrontend,
+		"OIDC_ADMIN_GROUP":   "greynote-admins",
+	})
+	return ts, idp
+}
+
+// startOIDCLogin begins a login and returns the IdP URL it redirects to.
+func (c *testClient) startOIDCLogin() string {
+	c.t.Helper()
+	resp, body := c.do(http.MethodGet, "/api/oidc/login", nil)
+	if resp.StatusCode != http.StatusFound {
+		c.t.Fatalf("oidc login: status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Header.Get("Location")
+}
+
+// oidcCallback returns where the callback redirects to: oidcTestHome on
+// success.
+func (c *testClient) oidcCallback(code, state string) string {
+	c.t.Helper()
+	resp, body := c.do(http.MethodGet, "/api/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if resp.StatusCode != http.StatusFound {
+		c.t.Fatalf("oidc callback: status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Header.Get("Location")
+}
+
+func (c *testClient) oidcLogin(idp *mockIdP, claims map[string]any) string {
+	c.t.Helper()
+	return c.oidcCallback(idp.authorize(c.startOIDCLogin(), claims))
+}
+
+// The frontend is served from its own origin, so the callback has to
+// redirect there rather than to a path on the backend.
+const (
+	oidcTestFrontend = "http://app.greynote.test"
+	oidcTestHome     = oidcTestFrontend + "/"
+)
+
+func ssoError(msg string) string {
+	return oidcTestFrontend + "/login?sso_error=" + url.QueryEscape(msg)
+}
+
+func TestOIDCProvisionsUserAndMapsAdminGroup(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+
+	c := ts.client(t)
+	claims := map[string]any{
+		"sub": "sub-1", "email": "New@Example.com", "email_verified": true,
+		"groups": []string{"staff", "greynote-admins"},
+	}
+	if got := c.oidcLogin(idp, claims); got != oidcTestHome {
+		t.Fatalf("callback redirected to %q", got)
+	}
+	me := c.me()
+	if me.Email != "new@example.com" || !me.IsAdmin {
+		t.Fatalf("first login: %+v", me)
+	}
+
+	// the same subject logs in to the same account, and admin follows
+	// the group on every login
+	c = ts.client(t)
+	claims["groups"] = []string{"staff"}
+	if got := c.oidcLogin(idp, claims); got != oidcTestHome {
+		t.Fatalf("callback redirected to %q", got)
+	}
+	again := c.me()
+	if again.UserID != me.UserID || again.IsAdmin {
+		t.Fatalf("second login: %+v, first was user %d", again, me.UserID)
+	}
+}
+
+func TestOIDCRequiresPKCEVerifier(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	c := ts.client(t)
+
+	code, state := idp.authorize(c.startOIDCLogin(), map[string]any{"sub": "sub-1", "email": "a@example.com"})
+	if _, err := ts.DB.Exec(`UPDATE oidc_states SET code_verifier = 'not-the-verifier' WHERE state = ?`, state); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.oidcCallback(code, state); got != ssoError("code exchange failed") {
+		t.Fatalf("callback redirected to %q", got)
+	}
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+}
+
+func TestOIDCRejectsStateMismatch(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	c := ts.client(t)
+	claims := map[string]any{"sub": "sub-1", "email": "a@example.com"}
+
+	code, _ := idp.authorize(c.startOIDCLogin(), claims)
+	if got := c.oidcCallback(code, "forged-state"); got != ssoError("state mismatch") {
+		t.Fatalf("forged state: redirected to %q", got)
+	}
+
+	// a state is good for one callback only
+	code, state := idp.authorize(c.startOIDCLogin(), claims)
+	if got := c.oidcCallback(code, state); got != oidcTestHome {
+		t.Fatalf("callback redirected to %q", got)
+	}
+	if got := c.oidcCallback(code, state); got != ssoError("state mismatch") {
+		t.Fatalf("replayed state: redirected to %q", got)
+	}
+
+	// another browser cannot complete this browser's login
+	code, state = idp.authorize(c.startOIDCLogin(), claims)
+	if got := ts.client(t).oidcCallback(code, state); got != ssoError("state mismatch") {
+		t.Fatalf("state from another browser: redirected to %q", got)
+	}
+}
+
+func TestOIDCLinksOnlyVerifiedEmail(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	adminID := ts.createUser(t, "root@example.com", "correct horse battery", true)
+
+	subject := func() string {
+		var s string
+		if err := ts.DB.QueryRow(`SELECT COALESCE(oidc_subject, '') FROM users WHERE id = ?`, adminID).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	for _, claims := range []map[string]any{
+		{"sub": "attacker", "email": "root@example.com"},
+		{"sub": "attacker", "email": "root@example.com", "email_verified": false},
+	} {
+		if got := ts.client(t).oidcLogin(idp, claims); got != ssoError("email not verified") {
+			t.Fatalf("%v: redirected to %q", claims, got)
+		}
+		if s := subject(); s != "" {
+			t.Fatalf("%v: account linked to %q", claims, s)
+		}
+	}
+
+	c := ts.client(t)
+	if got := c.oidcLogin(idp, map[string]any{"sub": "root-sub", "email": "root@example.com", "email_verified": true}); got != oidcTestHome {
+		t.Fatalf("verified email: redirected to %q", got)
+	}
+	if me := c.me(); me.UserID != adminID {
+		t.Fatalf("logged in as %d, want the existing account %d", me.UserID, adminID)
+	}
+	if s := subject(); s != "root-sub" {
+		t.Fatalf("linked subject = %q", s)
+	}
+}
+
+// Errors other than the expected refusals reach the login page only as a
+// fixed message; the details go to the log.
+func TestOIDCHidesProvisioningErrors(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	if _, err := ts.DB.Exec(`ALTER TABLE user_roles RENAME TO roles_gone`); err != nil {
+		t.Fatal(err)
+	}
+
+	c := ts.client(t)
+	claims := map[string]any{"sub": "sub-1", "email": "new@example.com", "email_verified": true}
+	if got := c.oidcLogin(idp, claims); got != ssoError("account could not be linked") {
+		t.Fatalf("redirected to %q", got)
+	}
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+
+	if got := ts.client(t).oidcLogin(idp, map[string]any{"sub": "sub-2"}); got != ssoError("identity provider did not supply an email") {
+		t.Fatalf("without an email: redirected to %q", got)
+	}
+}
+
+// An SSO account has no password to confirm deletion with; signing in again
+// stands in for it, and only for a while.
+func TestOIDCUserDeletesAccountAfterFreshSignIn(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	claims := map[string]any{"sub": "sub-1", "email": "sso@example.com", "email_verified": true}
+	c := ts.client(t)
+	c.oidcLogin(idp, claims)
+	me := c.me()
+
+	var profile struct {
+		HasPassword bool `json:"hasPassword"`
+	}
+	c.call(http.MethodGet, "/api/me/profile", nil, http.StatusOK, &profile)
+	if profile.HasPassword {
+		t.Fatal("SSO account reports a password")
+	}
+	c.call(http.MethodDelete, "/api/me", map[string]string{"password": "guess"}, http.StatusForbidden, nil)
+
+	stale := time.Now().Add(-deleteReauthWindow - time.Minute).UTC().Format(time.RFC3339)
+	if _, err := ts.DB.Exec(`UPDATE sessions SET created_at = ? WHERE user_id = ?`, stale, me.UserID); err != nil {
+		t.Fatal(err)
+	}
+	var refused struct {
+		Reauth bool `json:"reauth"`
+	}
+	c.call(http.MethodDelete, "/api/me", map[string]string{}, http.StatusForbidden, &refused)
+	if !refused.Reauth {
+		t.Fatal("stale session refused without asking to sign in again")
+	}
+
+	c.oidcLogin(idp, claims)
+	c.me()
+	c.call(http.MethodDelete, "/api/me", map[string]string{}, http.StatusNoContent, nil)
+	c.call(http.MethodGet, "/api/me", nil, http.StatusUnauthorized, nil)
+	if _, err := NewSQLStore(ts.DB).UserByID(context.Background(), me.UserID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("user after deletion: %v", err)
+	}
+
+	// password accounts still have to send theirs, however fresh the login
+	ts.createUser(t, "alice@example.com", "alice-password", false)
+	alice := ts.client(t)
+	alice.login("alice@example.com", "alice-password")
+	alice.call(http.MethodDelete, "/api/me", map[string]string{}, http.StatusBadRequest, nil)
+	var aliceProfile struct {
+		HasPassword bool `json:"hasPassword"`
+	}
+	alice.call(http.MethodGet, "/api/me/profile", nil, http.StatusOK, &aliceProfile)
+	if !aliceProfile.HasPassword {
+		t.Fatal("password account reports no password")
+	}
+}
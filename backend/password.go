@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords hashes and verifies user passwords and enforces the password
+// policy. New hashes use the configured algorithm; hashes in any supported
+// format still verify, and NeedsRehash tells callers when to upgrade them.
+type Passwords struct {
+	Algo       string
+	Argon2     Argon2Params
+	BcryptCost int
+
+	MinLength int
+	MaxLength int
+	// breached holds upper-case hex SHA-1 digests of known-breached passwords
+	breached map[string]struct{}
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+type Argon2Params struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+	KeyLen    uint32
+	SaltLen   uint32
+}
+
+const (
+	passwordAlgoArgon2id = "argon2id"
+	passwordAlgoBcrypt   = "bcrypt"
+
+	// bcrypt ignores everything past 72 bytes
+	bcryptMaxLength = 72
+)
+
+func NewPasswords(cfg Config) (*Passwords, error) {
+	p := &Passwords{
+		Algo: cfg.PasswordHash,
+		Argon2: Argon2Params{
+			Time:      cfg.Argon2Time,
+			MemoryKiB: cfg.Argon2MemoryKiB,
+			Threads:   cfg.Argon2Threads,
+			KeyLen:    32,
+			SaltLen:   16,
+		},
+		BcryptCost: cfg.BcryptCost,
+		MinLength:  cfg.PasswordMinLength,
+		MaxLength:  cfg.PasswordMaxLength,
+		breached:   map[string]struct{}{},
+	}
+	if p.Algo == passwordAlgoBcrypt && p.MaxLength > bcryptMaxLength {
+		p.MaxLength = bcryptMaxLength
+	}
+	if cfg.PasswordBreachedList != "" {
+		if err := p.loadBreached(cfg.PasswordBreachedList); err != nil {
+			return nil, fmt.Errorf("PASSWORD_BREACHED_LIST: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// loadBreached reads one password per line. Lines that are a 40-digit hex
+// SHA-1, optionally followed by ":count" (the Pwned Passwords format), are
+// taken as digests; anything else is taken as the password itself.
+func (p *Passwords) loadBreached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		digest, _, _ := strings.Cut(line, ":")
+		if _, err := hex.DecodeString(digest); err == nil && len(digest) == 2*sha1.Size {
+			p.breached[strings.ToUpper(digest)] = struct{}{}
+		} else {
+			p.breached[sha1Hex(line)] = struct{}{}
+		}
+	}
+	return sc.Err()
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Validate checks a new password against the policy.
+func (p *Passwords) Validate(password string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if n > p.MaxLength || (p.Algo == passwordAlgoBcrypt && len(password) > bcryptMaxLength) {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+	if _, ok := p.breached[sha1Hex(password)]; ok {
+		return errors.New("password appears in a list of breached passwords")
+	}
+	return nil
+}
+
+// Hash encodes password with the configured algorithm.
+func (p *Passwords) Hash(password string) (string, error) {
+	if p.Algo == passwordAlgoBcrypt {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		return string(h), err
+	}
+
+	salt := make([]byte, p.Argon2.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Argon2.Time, p.Argon2.MemoryKiB, p.Argon2.Threads, p.Argon2.KeyLen)
+
+	// PHC string format, as produced by the reference implementation
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Argon2.MemoryKiB, p.Argon2.Time, p.Argon2.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches encoded, which may be in any
+// supported format.
+func (p *Passwords) Verify(password, encoded string) bool {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+// VerifyDummy takes as long as Verify does against a current hash, for
+// logins without one to check, so response times do not tell which emails
+// have an account with a password.
+func (p *Passwords) VerifyDummy(password string) {
+	p.dummyOnce.Do(func() {
+		// made on first use so that CLI commands do not pay for it; what it
+		// hashes does not matter, since a match is ignored
+		p.dummy, _ = p.Hash("not a password")
+	})
+	p.Verify(password, p.dummy)
+}
+
+// NeedsRehash reports whether encoded was made with a different algorithm or
+// different parameters than new hashes would be.
+func (p *Passwords) NeedsRehash(encoded string) bool {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		if p.Algo != passwordAlgoArgon2id {
+			return true
+		}
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return true
+		}
+		return params.Time != p.Argon2.Time ||
+			params.MemoryKiB != p.Argon2.MemoryKiB ||
+			params.Threads != p.Argon2.Threads ||
+			uint32(len(salt)) != p.Argon2.SaltLen ||
+			uint32(len(key)) != p.Argon2.KeyLen
+	}
+
+	if p.Algo != passwordAlgoBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != p.BcryptCost
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	bad := errors.New("malformed argon2id hash")
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, bad
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, bad
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, bad
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, bad
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, bad
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
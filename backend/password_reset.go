@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Link tokens (password resets, workspace invitations) are stored as SHA-256
+// digests so a database leak does not hand out working links.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type updateUserReq struct {
+	Email *string `json:"email"`
+}
+
+type setPasswordReq struct {
+	Password string `json:"password"`
+}
+
+// PATCH /api/admin/users/:id
+func (h *AuthHandlers) UpdateUserAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID := h.checkManageable(c)
+	if targetID == 0 {
+		return
+	}
+
+	var req updateUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if req.Email == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	email := strings.TrimSpace(strings.ToLower(*req.Email))
+	if email == "" || !strings.Contains(email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid email required"})
+		return
+	}
+
+	other, err := h.Store.UserByEmail(ctx, email)
+	if err == nil && other.ID != targetID {
+		c.JSON(http.StatusConflict, gin.H{"error": "email already in use"})
+		return
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		internalError(c, "db error", err)
+		return
+	}
+
+	found, err := h.Store.SetUserEmail(ctx, targetID, email)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditUserUpdate, auditTarget("user", targetID), gin.H{"email": email})
+
+	c.Status(http.StatusNoContent)
+}
+
+// POST /api/admin/users/:id/password-reset
+// Issues a one-time set-password link, replacing any earlier one.
+func (h *AuthHandlers) IssuePasswordResetAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID := h.checkManageable(c)
+	if targetID == 0 {
+		return
+	}
+
+	token, expiresAt, err := issuePasswordReset(ctx, h.Store, targetID, getUserID(c), h.Cfg.PasswordResetTTL)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	writeAudit(h.Store, c, getUserID(c), auditPasswordResetIssue, auditTarget("user", targetID), gin.H{"expiresAt": expiresAt})
+
+	c.JSON(http.StatusOK, gin.H{
+		"resetUrl":  "/reset-password/" + token,
+		"expiresAt": expiresAt,
+	})
+}
+
+// issuePasswordReset creates a set-password link for userID that replaces
+// any earlier one, and returns its token. createdBy is 0 for the CLI.
+func issuePasswordReset(ctx context.Context, store Store, userID, createdBy int64, ttl time.Duration) (string, string, error) {
+	token, err := randomTokenURLSafe(32)
+	if err != nil {
+		return "", "", err
+	}
+	r := PasswordReset{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().UTC().Add(ttl).Format(time.RFC3339),
+		CreatedBy: createdBy,
+		CreatedAt: nowRFC3339(),
+	}
+	if err := store.CreatePasswordReset(ctx, &r); err != nil {
+		return "", "", err
+	}
+	return token, r.ExpiresAt, nil
+}
+
+// GET /api/password-reset/:token (public): is the link still usable?
+func (h *AuthHandlers) CheckPasswordReset(c *gin.Context) {
+	ctx := c.Request.Context()
+	r, err := h.Store.PasswordReset(ctx, hashToken(c.Param("token")), nowRFC3339())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "link invalid or expired"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"email": r.Email})
+}
+
+// POST /api/password-reset/:token (public)
+// Sets the new password, consumes the link and ends all existing sessions.
+func (h *AuthHandlers) CompletePasswordReset(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req setPasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if err := h.Passwords.Validate(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash, err := h.Passwords.Hash(req.Password)
+	if err != nil {
+		internalError(c, "hash error", err)
+		return
+	}
+
+	userID, err := h.Store.CompletePasswordReset(ctx, hashToken(c.Param("token")), nowRFC3339(), hash)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "link invalid or expired"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, userID, auditPasswordResetFinish, auditTarget("user", userID), nil)
+
+	c.Status(http.StatusNoContent)
+}
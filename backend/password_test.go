@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2 keeps argon2id cheap enough for tests.
+var fastArgon2 = map[string]string{
+	"PASSWORD_HASH":     passwordAlgoArgon2id,
+	"ARGON2_TIME":       "1",
+	"ARGON2_MEMORY_KIB": "64",
+	"ARGON2_THREADS":    "1",
+}
+
+func newTestPasswords(t *testing.T, overrides map[string]string) *Passwords {
+	t.Helper()
+	p, err := NewPasswords(testConfig(t, overrides))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestArgon2idPHCFormat(t *testing.T) {
+	p := newTestPasswords(t, fastArgon2)
+	encoded, err := p.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`).MatchString(encoded) {
+		t.Fatalf("hash %q is not a PHC string with the configured parameters", encoded)
+	}
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != p.Argon2 || len(salt) != 16 || len(key) != 32 {
+		t.Fatalf("decoded %+v with %d-byte salt and %d-byte key, want %+v", params, len(salt), len(key), p.Argon2)
+	}
+	if !p.Verify("correct horse", encoded) || p.Verify("wrong horse", encoded) {
+		t.Fatal("Verify does not check the password against its own hash")
+	}
+
+	// the layout of the reference implementation's encoded hashes
+	const reference = "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$SyGfDhMyhRRAKupvTAzmRwgf2ncBYAbIMgNaXyvtIgM"
+	if _, _, _, err := decodeArgon2id(reference); err != nil {
+		t.Fatalf("reference hash: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		encoded string
+	}{
+		{"too few fields", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ"},
+		{"other version", strings.Replace(reference, "v=19", "v=16", 1)},
+		{"bad parameters", strings.Replace(reference, "m=64,t=1,p=1", "m=64;t=1;p=1", 1)},
+		{"bad salt", strings.Replace(reference, "c29tZXNhbHQ", "c29t!!!", 1)},
+		{"empty key", reference[:strings.LastIndex(reference, "$")+1]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := decodeArgon2id(tt.encoded); err == nil {
+				t.Fatalf("decodeArgon2id(%q) accepted it", tt.encoded)
+			}
+			if p.Verify("password", tt.encoded) {
+				t.Fatal("Verify accepted a malformed hash")
+			}
+			if !p.NeedsRehash(tt.encoded) {
+				t.Fatal("NeedsRehash kept a malformed hash")
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon := newTestPasswords(t, fastArgon2)
+	current, err := argon.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(k, v string) map[string]string {
+		m := map[string]string{}
+		for key, val := range fastArgon2 {
+			m[key] = val
+		}
+		m[k] = v
+		return m
+	}
+	for _, tt := range []struct {
+		name    string
+		cfg     map[string]string
+		encoded string
+		want    bool
+	}{
+		{"same parameters", fastArgon2, current, false},
+		{"more iterations", with("ARGON2_TIME", "2"), current, true},
+		{"more memory", with("ARGON2_MEMORY_KIB", "128"), current, true},
+		{"more threads", with("ARGON2_THREADS", "2"), current, true},
+		{"switched to bcrypt", map[string]string{"PASSWORD_HASH": passwordAlgoBcrypt, "BCRYPT_COST": "4"}, current, true},
+		{"bcrypt under argon2id", fastArgon2, string(bcryptHash), true},
+		{"bcrypt, same cost", map[string]string{"BCRYPT_COST": "4"}, string(bcryptHash), false},
+		{"bcrypt, higher cost", map[string]string{"BCRYPT_COST": "5"}, string(bcryptHash), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestPasswords(t, tt.cfg).NeedsRehash(tt.encoded); got != tt.want {
+				t.Fatalf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Logging in with a bcrypt hash under PASSWORD_HASH=argon2id replaces it,
+// and the new hash works for the next login.
+func TestLoginUpgradesBcryptHash(t *testing.T) {
+	ts := newTestServer(t, fastArgon2)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := User{Email: "alice@example.com", CreatedAt: nowRFC3339()}
+	store := NewSQLStore(ts.DB)
+	if err := store.CreateUser(context.Background(), &u, string(bcryptHash)); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.client(t).login("alice@example.com", "alice-password")
+	_, stored, err := store.PasswordHash(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$argon2id$") || ts.Passwords.NeedsRehash(stored) {
+		t.Fatalf("hash after login = %q, want a current argon2id hash", stored)
+	}
+	ts.client(t).login("alice@example.com", "alice-password")
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	list := strings.Join([]string{
+		sha1Hex("password123"),                          // bare digest
+		strings.ToLower(sha1Hex("letmein!!")) + ":4711", // Pwned Passwords line
+		"",
+		"  hunter2hunter2  ", // plain password
+	}, "\n")
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPasswords(t, map[string]string{"PASSWORD_BREACHED_LIST": path})
+	if len(p.breached) != 3 {
+		t.Fatalf("loaded %d entries, want 3", len(p.breached))
+	}
+
+	for _, tt := range []struct {
+		password string
+		breached bool
+	}{
+		{"password123", true},
+		{"letmein!!", true},
+		{"hunter2hunter2", true},
+		{"Password123", false},
+		{"a fine passphrase", false},
+	} {
+		err := p.Validate(tt.password)
+		if got := err != nil && strings.Contains(err.Error(), "breached"); got != tt.breached {
+			t.Errorf("Validate(%q) = %v, want breached %v", tt.password, err, tt.breached)
+		}
+	}
+
+	if _, err := NewPasswords(testConfig(t, map[string]string{"PASSWORD_BREACHED_LIST": filepath.Join(t.TempDir(), "missing")})); err == nil {
+		t.Fatal("NewPasswords accepted a missing breached list")
+	}
+}
+
+// Unknown emails and accounts without a password cost a hash verification
+// like any other login, so timing does not reveal which accounts exist.
+func TestPasswordAuthenticatorVerifiesDummyHash(t *testing.T) {
+	ts := newTestServer(t, nil)
+	store := NewSQLStore(ts.DB)
+	sso := User{Email: "sso@example.com", CreatedAt: nowRFC3339()}
+	if err := store.CreateUser(context.Background(), &sso, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		email string
+		want  error
+	}{
+		{"nobody@example.com", ErrUnknownUser},
+		{"sso@example.com", ErrBadPassword},
+	} {
+		pw := newTestPasswords(t, nil)
+		a := &PasswordAuthenticator{Store: store, Passwords: pw}
+		if _, err := a.Authenticate(context.Background(), tt.email, "guess"); !errors.Is(err, tt.want) {
+			t.Fatalf("%s: error = %v, want %v", tt.email, err, tt.want)
+		}
+		if !strings.HasPrefix(pw.dummy, "$2") {
+			t.Fatalf("%s: rejected without verifying a dummy hash", tt.email)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDisplayNameLength = 80
+	maxAvatarBytes       = 1 << 20
+)
+
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// BCP 47-ish: "en", "pt-BR", "zh-Hant-TW"
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Preferences are the per-user UI settings kept in users.preferences. Empty
+// fields mean "use the default".
+type Preferences struct {
+	EditorMode  string `json:"editorMode,omitempty"`  // "edit" or "preview"
+	DefaultSort string `json:"defaultSort,omitempty"` // "updated", "created" or "title"
+	Theme       string `json:"theme,omitempty"`       // "light", "dark" or "system"
+}
+
+func (p Preferences) validate() string {
+	check := func(name, v string, allowed ...string) string {
+		if v == "" {
+			return ""
+		}
+		for _, a := range allowed {
+			if v == a {
+				return ""
+			}
+		}
+		return name + " must be one of " + strings.Join(allowed, ", ")
+	}
+	if msg := check("editorMode", p.EditorMode, "edit", "preview"); msg != "" {
+		return msg
+	}
+	if msg := check("defaultSort", p.DefaultSort, "updated", "created", "title"); msg != "" {
+		return msg
+	}
+	return check("theme", p.Theme, "light", "dark", "system")
+}
+
+type profileDTO struct {
+	Email       string      `json:"email"`
+	DisplayName string      `json:"displayName"`
+	Timezone    string      `json:"timezone"`
+	Locale      string      `json:"locale"`
+	Preferences Preferences `json:"preferences"`
+	AvatarURL   string      `json:"avatarUrl,omitempty"`
+	// HasPassword is false for accounts that only sign in through SSO or
+	// LDAP; they confirm account deletion by signing in again.
+	HasPassword bool `json:"hasPassword"`
+}
+
+type profileReq struct {
+	DisplayName string      `json:"displayName"`
+	Timezone    string      `json:"timezone"`
+	Locale      string      `json:"locale"`
+	Preferences Preferences `json:"preferences"`
+}
+
+func avatarURL(userID int64, updatedAt string) string {
+	// the timestamp busts caches when the picture changes
+	return "/api/users/" + strconv.FormatInt(userID, 10) + "/avatar?v=" + updatedAt
+}
+
+// userLocation returns the time zone from userID's profile, or UTC if none
+// is set.
+func userLocation(ctx context.Context, store Store, userID int64) (*time.Location, error) {
+	u, err := store.UserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(u.Timezone)
+}
+
+// inLocation re-renders a stored RFC 3339 timestamp with loc's offset. Values
+// that do not parse are returned unchanged.
+func inLocation(ts string, loc *time.Location) string {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ts
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// GET /api/me/profile
+func (h *AuthHandlers) GetProfile(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := getUserID(c)
+
+	u, err := h.Store.UserByID(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	avatarUpdated, err := h.Store.AvatarUpdatedAt(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	_, hash, err := h.Store.PasswordHash(ctx, u.Email)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	p := profileDTO{Email: u.Email, DisplayName: u.DisplayName, Timezone: u.Timezone, Locale: u.Locale, HasPassword: hash != ""}
+	// a corrupt blob just means default preferences
+	_ = json.Unmarshal([]byte(u.Preferences), &p.Preferences)
+	if avatarUpdated != "" {
+		p.AvatarURL = avatarURL(userID, avatarUpdated)
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+// PUT /api/me/profile
+// Replaces display name, time zone, locale and preferences.
+func (h *AuthHandlers) UpdateProfile(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req profileReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if utf8.RuneCountInString(req.DisplayName) > maxDisplayNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "display name must be at most " + strconv.Itoa(maxDisplayNameLength) + " characters"})
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "Local" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown time zone"})
+			return
+		}
+	}
+	if req.Locale != "" && !localePattern.MatchString(req.Locale) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad locale"})
+		return
+	}
+	if msg := req.Preferences.validate(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	prefs, err := json.Marshal(req.Preferences)
+	if err != nil {
+		internalError(c, "json error", err)
+		return
+	}
+
+	if err := h.Store.UpdateProfile(ctx, getUserID(c), req.DisplayName, req.Timezone, req.Locale, string(prefs)); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PUT /api/me/avatar (multipart form, field "avatar")
+func (h *AuthHandlers) UploadAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarBytes+64<<10)
+	fh, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "avatar file required (max 1 MiB)"})
+		return
+	}
+	if fh.Size > maxAvatarBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "avatar must be at most 1 MiB"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad upload"})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxAvatarBytes+1))
+	if err != nil || len(data) > maxAvatarBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad upload"})
+		return
+	}
+
+	// trust the bytes, not the client's Content-Type
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "avatar must be PNG, JPEG, GIF or WebP"})
+		return
+	}
+
+	now := nowRFC3339()
+	if err := h.Store.SetAvatar(ctx, Avatar{UserID: getUserID(c), ContentType: contentType, Data: data, UpdatedAt: now}); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"avatarUrl": avatarURL(getUserID(c), now)})
+}
+
+// DELETE /api/me/avatar
+func (h *AuthHandlers) DeleteAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+	if err := h.Store.DeleteAvatar(ctx, getUserID(c)); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/users/:id/avatar
+func (h *AuthHandlers) GetAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	a, err := h.Store.Avatar(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, a.ContentType, a.Data)
+}
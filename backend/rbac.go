@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions checked by RequirePermission. permAll grants every permission.
+const (
+	permAll              = "*"
+	permUsersRead        = "users.read"
+	permUsersWrite       = "users.write"
+	permUsersImpersonate = "users.impersonate"
+	permSessionsRead     = "sessions.read"
+	permSessionsManage   = "sessions.manage"
+	permLockoutsRead     = "lockouts.read"
+	permLockoutsManage   = "lockouts.manage"
+	permRolesRead        = "roles.read"
+	permRolesManage      = "roles.manage"
+	permAuditRead        = "audit.read"
+	permBackupsManage    = "backups.manage"
+)
+
+var allPermissions = []string{
+	permUsersRead, permUsersWrite, permUsersImpersonate,
+	permSessionsRead, permSessionsManage,
+	permLockoutsRead, permLockoutsManage,
+	permRolesRead, permRolesManage,
+	permAuditRead,
+	permBackupsManage,
+}
+
+const roleSuperuser = "superuser"
+
+// builtinRoles are recreated on every start so they pick up new permissions.
+var builtinRoles = []struct {
+	name, description string
+	permissions       []string
+}{
+	{roleSuperuser, "Full access", []string{permAll}},
+	{"user-manager", "Create, delete and manage user accounts",
+		[]string{permUsersRead, permUsersWrite, permSessionsRead, permSessionsManage, permLockoutsRead, permLockoutsManage, permRolesRead}},
+	{"auditor", "Read-only access to users, sessions, lockouts and the audit log",
+		[]string{permUsersRead, permSessionsRead, permLockoutsRead, permRolesRead, permAuditRead}},
+	{"support", "Help users with sessions and lockouts",
+		[]string{permUsersRead, permUsersImpersonate, permSessionsRead, permSessionsManage, permLockoutsRead, permLockoutsManage}},
+}
+
+func seedRoles(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range builtinRoles {
+		_, err := tx.Exec(
+			`INSERT INTO roles(name, description, builtin, created_at) VALUES(?,?,1,?)
+			ON CONFLICT(name) DO UPDATE SET description = excluded.description, builtin = 1`,
+			r.name, r.description, nowRFC3339(),
+		)
+		if err != nil {
+			return err
+		}
+		var roleID int64
+		if err := tx.QueryRow(`SELECT id FROM roles WHERE name = ?`, r.name).Scan(&roleID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role_id = ?`, roleID); err != nil {
+			return err
+		}
+		for _, p := range r.permissions {
+			if _, err := tx.Exec(`INSERT INTO role_permissions(role_id, permission) VALUES(?,?)`, roleID, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	// accounts flagged admin before roles existed become superusers
+	_, err = tx.Exec(
+		`INSERT INTO user_roles(user_id, role_id)
+		SELECT u.id, r.id FROM users u, roles r WHERE u.is_admin = 1 AND r.name = ?
+		ON CONFLICT DO NOTHING`,
+		roleSuperuser,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// setSuperuser grants or revokes the superuser role. users.is_admin mirrors
+// that role so existing clients of the flag keep working.
+func setSuperuser(ctx context.Context, db execer, userID int64, on bool) error {
+	val := 0
+	if on {
+		val = 1
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE users SET is_admin = ? WHERE id = ?`, val, userID); err != nil {
+		return err
+	}
+
+	var err error
+	if on {
+		_, err = db.ExecContext(ctx,
+			`INSERT INTO user_roles(user_id, role_id) SELECT CAST(? AS BIGINT), id FROM roles WHERE name = ?
+			ON CONFLICT DO NOTHING`,
+			userID, roleSuperuser,
+		)
+	} else {
+		_, err = db.ExecContext(ctx,
+			`DELETE FROM user_roles WHERE user_id = ? AND role_id = (SELECT id FROM roles WHERE name = ?)`,
+			userID, roleSuperuser,
+		)
+	}
+	return err
+}
+
+func hasPermission(perms []string, want string) bool {
+	return slices.Contains(perms, permAll) || slices.Contains(perms, want)
+}
+
+// outranks reports whether actorPerms cover every permission targetID holds,
+// so that admins cannot act on accounts more privileged than their own.
+func outranks(ctx context.Context, store Store, actorPerms []string, targetID int64) (bool, error) {
+	targetPerms, err := store.UserPermissions(ctx, targetID)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range targetPerms {
+		if !hasPermission(actorPerms, p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type RoleHandlers struct {
+	DB    *sql.DB
+	Store Store
+}
+
+func NewRoleHandlers(db *sql.DB, store Store) *RoleHandlers {
+	return &RoleHandlers{DB: db, Store: store}
+}
+
+type roleDTO struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Builtin     bool     `json:"builtin"`
+	Permissions []string `json:"permissions"`
+}
+
+type roleUpsertReq struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type userRolesReq struct {
+	Roles []string `json:"roles"`
+}
+
+func (h *RoleHandlers) loadRoles(ctx context.Context, where string, args ...any) ([]roleDTO, error) {
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT r.id, r.name, r.description, r.builtin, COALESCE(rp.permission, '')
+		FROM roles r LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		`+where+` ORDER BY r.id, rp.permission`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []roleDTO{}
+	for rows.Next() {
+		var r roleDTO
+		var builtin int
+		var perm string
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &builtin, &perm); err != nil {
+			return nil, err
+		}
+		if n := len(out); n == 0 || out[n-1].ID != r.ID {
+			r.Builtin = builtin == 1
+			r.Permissions = []string{}
+			out = append(out, r)
+		}
+		if perm != "" {
+			last := &out[len(out)-1]
+			last.Permissions = append(last.Permissions, perm)
+		}
+	}
+	return out, rows.Err()
+}
+
+// GET /api/admin/roles
+func (h *RoleHandlers) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	out, err := h.loadRoles(ctx, "")
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": out, "permissions": allPermissions})
+}
+
+func validPermissions(perms []string) bool {
+	for _, p := range perms {
+		if !slices.Contains(allPermissions, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingPermission returns the first of perms that actorPerms do not grant,
+// or "" if they grant all of them.
+func missingPermission(actorPerms, perms []string) string {
+	for _, p := range perms {
+		if !hasPermission(actorPerms, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// outranksRoleHolders reports whether the actor outranks everyone holding
+// roleID. Editing or deleting a role changes what its holders may do, which
+// is only allowed for holders whose roles the actor could change directly.
+func (h *RoleHandlers) outranksRoleHolders(ctx context.Context, actorPerms []string, roleID int64) (bool, error) {
+	rows, err := h.DB.QueryContext(ctx, `SELECT user_id FROM user_roles WHERE role_id = ?`, roleID)
+	if err != nil {
+		return false, err
+	}
+	var holders []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return false, err
+		}
+		holders = append(holders, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, id := range holders {
+		ok, err := outranks(ctx, h.Store, actorPerms, id)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// POST /api/admin/roles
+func (h *RoleHandlers) Create(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req roleUpsertReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	req.Name = strings.TrimSpace(strings.ToLower(req.Name))
+	if req.Name == "" || !validPermissions(req.Permissions) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required, permissions must be known"})
+		return
+	}
+
+	// a role may only carry permissions its creator holds
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if p := missingPermission(actorPerms, req.Permissions); p != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant permission " + p})
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO roles(name, description, builtin, created_at) VALUES(?,?,0,?) RETURNING id`,
+		req.Name, req.Description, nowRFC3339(),
+	).Scan(&id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role exists or db error"})
+		return
+	}
+	for _, p := range req.Permissions {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO role_permissions(role_id, permission) VALUES(?,?) ON CONFLICT DO NOTHING`, id, p); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	writeAudit(h.Store, c, getUserID(c), auditRoleCreate, auditTarget("role", id), gin.H{"name": req.Name, "permissions": req.Permissions})
+
+	c.JSON(http.StatusCreated, gin.H{"id": id})
+}
+
+// PUT /api/admin/roles/:id
+func (h *RoleHandlers) Update(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad role id"})
+		return
+	}
+	var req roleUpsertReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if !validPermissions(req.Permissions) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission"})
+		return
+	}
+
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if p := missingPermission(actorPerms, req.Permissions); p != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant permission " + p})
+		return
+	}
+	ok, err := h.outranksRoleHolders(ctx, actorPerms, id)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "role is held by a user you cannot manage"})
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var builtin int
+	if err := tx.QueryRowContext(ctx, `SELECT builtin FROM roles WHERE id = ?`, id).Scan(&builtin); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if builtin == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "built-in roles cannot be changed"})
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE roles SET description = ? WHERE id = ?`, req.Description, id); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role_id = ?`, id); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	for _, p := range req.Permissions {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO role_permissions(role_id, permission) VALUES(?,?) ON CONFLICT DO NOTHING`, id, p); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditRoleUpdate, auditTarget("role", id), gin.H{"permissions": req.Permissions})
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/admin/roles/:id
+func (h *RoleHandlers) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad role id"})
+		return
+	}
+
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	ok, err := h.outranksRoleHolders(ctx, actorPerms, id)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "role is held by a user you cannot manage"})
+		return
+	}
+
+	res, err := h.DB.ExecContext(ctx, `DELETE FROM roles WHERE id = ? AND builtin = 0`, id)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	aff, _ := res.RowsAffected()
+	if aff == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found or built-in"})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditRoleDelete, auditTarget("role", id), nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/admin/users/:id/roles
+func (h *RoleHandlers) ListUserRoles(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	out, err := h.loadRoles(ctx, `WHERE r.id IN (SELECT role_id FROM user_roles WHERE user_id = ?)`, targetID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// PUT /api/admin/users/:id/roles
+func (h *RoleHandlers) SetUserRoles(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+	var req userRolesReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+
+	// safety: do not allow changing your own roles
+	if targetID == getUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot change your own roles"})
+		return
+	}
+
+	actorPerms, err := h.Store.UserPermissions(ctx, getUserID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	// nor take roles away from someone holding permissions you lack
+	ok, err := outranks(ctx, h.Store, actorPerms, targetID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot change roles of this user"})
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var dummy int64
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = ?`, targetID).Scan(&dummy); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	roleIDs := []int64{}
+	superuser := false
+	for _, name := range req.Roles {
+		var roleID int64
+		if err := tx.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = ?`, name).Scan(&roleID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role " + name})
+			return
+		}
+
+		// you can only hand out permissions you hold yourself
+		rows, err := tx.QueryContext(ctx, `SELECT permission FROM role_permissions WHERE role_id = ?`, roleID)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		allowed := true
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err != nil || !hasPermission(actorPerms, p) {
+				allowed = false
+			}
+		}
+		rows.Close()
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant role " + name})
+			return
+		}
+
+		roleIDs = append(roleIDs, roleID)
+		superuser = superuser || name == roleSuperuser
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ?`, targetID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	for _, roleID := range roleIDs {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_roles(user_id, role_id) VALUES(?,?) ON CONFLICT DO NOTHING`, targetID, roleID); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+	}
+	if err := setSuperuser(ctx, tx, targetID, superuser); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditUserSetRoles, auditTarget("user", targetID), gin.H{"roleIds": roleIDs})
+
+	c.Status(http.StatusNoContent)
+}
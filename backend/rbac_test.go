@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRoleManagersCannotEscalate(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser(t, "root@example.com", "root-password", true)
+	carolID := ts.createUser(t, "carol@example.com", "carol-password", false)
+	daveID := ts.createUser(t, "dave@example.com", "dave-password", false)
+
+	root := ts.client(t)
+	root.login("root@example.com", "root-password")
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	root.call(http.MethodPost, "/api/admin/roles", gin.H{"name": "role-admin", "permissions": []string{permRolesRead, permRolesManage, permUsersRead}}, http.StatusCreated, &created)
+	roleAdminID := created.ID
+	root.call(http.MethodPost, "/api/admin/roles", gin.H{"name": "ops", "permissions": []string{permBackupsManage}}, http.StatusCreated, &created)
+	opsID := created.ID
+	root.call(http.MethodPut, fmt.Sprintf("/api/admin/users/%d/roles", carolID), gin.H{"roles": []string{"role-admin"}}, http.StatusNoContent, nil)
+	root.call(http.MethodPut, fmt.Sprintf("/api/admin/users/%d/roles", daveID), gin.H{"roles": []string{"ops"}}, http.StatusNoContent, nil)
+
+	carol := ts.client(t)
+	carol.login("carol@example.com", "carol-password")
+
+	// permissions carol lacks cannot go into a new role or an existing one,
+	// her own included
+	carol.call(http.MethodPost, "/api/admin/roles", gin.H{"name": "sneaky", "permissions": []string{permBackupsManage}}, http.StatusForbidden, nil)
+	carol.call(http.MethodPut, fmt.Sprintf("/api/admin/roles/%d", roleAdminID), gin.H{"permissions": []string{permRolesRead, permRolesManage, permUsersRead, permUsersImpersonate}}, http.StatusForbidden, nil)
+
+	// nor can she change or delete a role held by someone she does not outrank
+	carol.call(http.MethodPut, fmt.Sprintf("/api/admin/roles/%d", opsID), gin.H{"permissions": []string{permUsersRead}}, http.StatusForbidden, nil)
+	carol.call(http.MethodDelete, fmt.Sprintf("/api/admin/roles/%d", opsID), nil, http.StatusForbidden, nil)
+
+	// within her own permissions she manages roles as before
+	carol.call(http.MethodPost, "/api/admin/roles", gin.H{"name": "viewer", "permissions": []string{permUsersRead}}, http.StatusCreated, &created)
+	carol.call(http.MethodPut, fmt.Sprintf("/api/admin/roles/%d", created.ID), gin.H{"permissions": []string{permUsersRead, permRolesRead}}, http.StatusNoContent, nil)
+	carol.call(http.MethodDelete, fmt.Sprintf("/api/admin/roles/%d", created.ID), nil, http.StatusNoContent, nil)
+
+	var perms []string
+	rows, err := ts.DB.Query(`SELECT permission FROM role_permissions WHERE role_id = ?`, opsID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		perms = append(perms, p)
+	}
+	if len(perms) != 1 || perms[0] != permBackupsManage {
+		t.Fatalf("ops role now has %v", perms)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewRouter builds the complete HTTP API. It has no side effects beyond the
+// handlers it wires up, so it can be served by main or driven directly with
+// httptest against a database from openDB(Config{Ephemeral: true}).
+func NewRouter(db *sql.DB, store Store, cfg Config, passwords *Passwords) *gin.Engine {
+	r := gin.New()
+	// loadConfig has already validated the list
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		panic(err)
+	}
+	r.Use(RequestID(), Tracing(), AccessLog(), Metrics(), Recovery())
+	r.Use(CORSMiddleware(cfg.FrontendOrigin))
+
+	// health
+	r.GET("/health", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	if cfg.MetricsEnabled && cfg.MetricsAddr == "" {
+		r.GET("/metrics", gin.WrapH(metricsHandler(cfg.MetricsToken)))
+	}
+
+	auth := NewAuthHandlers(store, cfg, passwords)
+	notes := NewNotesHandlers(store)
+	roles := NewRoleHandlers(db, store)
+	audit := NewAuditHandlers(db, store)
+	workspaces := NewWorkspaceHandlers(db, store, cfg)
+
+	api := r.Group("/api")
+	api.Use(OriginCheck(cfg))
+	{
+		// auth (public)
+		//api.POST("/register", auth.Register)
+		api.POST("/login", auth.Login)
+		api.GET("/auth/config", auth.AuthConfig)
+		api.GET("/password-reset/:token", auth.CheckPasswordReset)
+		api.POST("/password-reset/:token", auth.CompletePasswordReset)
+
+		if cfg.OIDCEnabled() {
+			oidcH := NewOIDCHandlers(store, cfg, auth)
+			api.GET("/oidc/login", oidcH.Login)
+			api.GET("/oidc/callback", oidcH.Callback)
+		}
+
+		// share (public)
+		api.GET("/share/:token", notes.GetShared)
+
+		// authenticated
+		pr := api.Group("/")
+		pr.Use(AuthRequired(store, cfg), CSRFRequired())
+		{
+			// behind the CSRF check so other sites cannot log users out
+			pr.POST("/logout", auth.Logout)
+
+			admin := pr.Group("/admin")
+			admin.Use(NotImpersonating())
+			{
+				perm := func(p string) gin.HandlerFunc { return RequirePermission(store, p) }
+
+				admin.GET("/users", perm(permUsersRead), auth.ListUsersAdmin)
+				admin.POST("/users", perm(permUsersWrite), auth.CreateUserAdmin)
+				admin.PUT("/users/:id/admin", perm(permAll), auth.SetAdminFlag)
+				admin.PATCH("/users/:id", perm(permUsersWrite), auth.UpdateUserAdmin)
+				admin.DELETE("/users/:id", perm(permUsersWrite), auth.DeleteUserAdmin)
+				admin.POST("/users/:id/password-reset", perm(permUsersWrite), auth.IssuePasswordResetAdmin)
+				admin.POST("/users/:id/suspend", perm(permUsersWrite), auth.SuspendUserAdmin)
+				admin.POST("/users/:id/reactivate", perm(permUsersWrite), auth.ReactivateUserAdmin)
+				admin.POST("/users/:id/schedule-deletion", perm(permUsersWrite), auth.ScheduleDeletionAdmin)
+				admin.POST("/users/:id/impersonate", perm(permUsersImpersonate), auth.StartImpersonationAdmin)
+				admin.GET("/impersonations", perm(permUsersRead), auth.ListImpersonationsAdmin)
+
+				admin.GET("/users/:id/sessions", perm(permSessionsRead), auth.ListUserSessionsAdmin)
+				admin.DELETE("/users/:id/sessions", perm(permSessionsManage), auth.RevokeUserSessionsAdmin)
+				admin.DELETE("/users/:id/sessions/:sid", perm(permSessionsManage), auth.RevokeUserSessionAdmin)
+
+				admin.GET("/lockouts", perm(permLockoutsRead), auth.Throttle.ListLockoutsAdmin)
+				admin.DELETE("/lockouts/:id", perm(permLockoutsManage), auth.Throttle.ClearLockoutAdmin)
+				admin.GET("/login-attempts", perm(permLockoutsRead), auth.Throttle.ListAttemptsAdmin)
+
+				admin.GET("/roles", perm(permRolesRead), roles.List)
+				admin.POST("/roles", perm(permRolesManage), roles.Create)
+				admin.PUT("/roles/:id", perm(permRolesManage), roles.Update)
+				admin.DELETE("/roles/:id", perm(permRolesManage), roles.Delete)
+				admin.GET("/users/:id/roles", perm(permRolesRead), roles.ListUserRoles)
+				admin.PUT("/users/:id/roles", perm(permRolesManage), roles.SetUserRoles)
+
+				admin.GET("/audit", perm(permAuditRead), audit.List)
+				admin.GET("/audit/export", perm(permAuditRead), audit.Export)
+
+				if dialectOf(db) == dialectSQLite {
+					backups := NewBackupHandlers(db, store, cfg)
+					admin.GET("/backups", perm(permBackupsManage), backups.List)
+					admin.POST("/backups", perm(permBackupsManage), backups.Create)
+					admin.GET("/backups/:name", perm(permBackupsManage), backups.Download)
+				}
+			}
+
+			pr.GET("/me", auth.Me)
+			pr.DELETE("/me", NotImpersonating(), auth.DeleteMe)
+			pr.POST("/me/export", NotImpersonating(), auth.ExportMe)
+			pr.GET("/me/sessions", auth.ListMySessions)
+			pr.DELETE("/me/sessions/:id", NotImpersonating(), auth.RevokeMySession)
+			pr.POST("/me/sessions/revoke-others", NotImpersonating(), auth.RevokeOtherSessions)
+			pr.POST("/me/impersonation/end", auth.EndImpersonation)
+			pr.GET("/me/profile", auth.GetProfile)
+			pr.PUT("/me/profile", auth.UpdateProfile)
+			pr.PUT("/me/avatar", auth.UploadAvatar)
+			pr.DELETE("/me/avatar", auth.DeleteAvatar)
+			pr.GET("/users/:id/avatar", auth.GetAvatar)
+
+			pr.GET("/workspaces", workspaces.List)
+			pr.POST("/workspaces", workspaces.Create)
+			pr.PATCH("/workspaces/:id", workspaces.Update)
+			pr.DELETE("/workspaces/:id", workspaces.Delete)
+			pr.GET("/workspaces/:id/members", workspaces.ListMembers)
+			pr.PUT("/workspaces/:id/members/:userId", workspaces.SetMemberRole)
+			pr.DELETE("/workspaces/:id/members/:userId", workspaces.RemoveMember)
+			pr.GET("/workspaces/:id/invitations", workspaces.ListInvitations)
+			pr.POST("/workspaces/:id/invitations", workspaces.Invite)
+			pr.DELETE("/workspaces/:id/invitations/:invId", workspaces.RevokeInvitation)
+			pr.GET("/invitations/:token", workspaces.GetInvitation)
+			pr.POST("/invitations/:token/accept", workspaces.AcceptInvitation)
+
+			pr.GET("/notes", notes.List)
+			pr.POST("/notes", notes.Create)
+			pr.GET("/notes/:id", notes.Get)
+			pr.PUT("/notes/:id", notes.Update)
+			pr.DELETE("/notes/:id", notes.Delete)
+
+			pr.POST("/notes/:id/share", notes.CreateOrEnableShare)
+			pr.POST("/notes/:id/share/disable", notes.DisableShare)
+		}
+	}
+	return r
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify turns a note title into something safe for a file name.
+func slugify(title string) string {
+	s := strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(s) > 60 {
+		s = strings.TrimRight(s[:60], "-")
+	}
+	if s == "" {
+		s = "untitled"
+	}
+	return s
+}
+
+type exportNote struct {
+	ID        int64  `json:"id"`
+	Title     string `json:"title"`
+	Workspace string `json:"workspace"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+	File      string `json:"file"`
+	content   string
+}
+
+type exportShareLink struct {
+	NoteID    int64  `json:"noteId"`
+	URL       string `json:"url"`
+	Enabled   bool   `json:"enabled"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// POST /api/me/export
+// Responds with a zip of the caller's profile, the notes they wrote (as
+// Markdown plus JSON metadata) and their share links.
+func (h *AuthHandlers) ExportMe(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := getUserID(c)
+
+	u, err := h.Store.UserByID(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	perms, err := h.Store.UserPermissions(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	authored, err := h.Store.AuthoredNotes(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	notes := make([]exportNote, 0, len(authored))
+	for _, n := range authored {
+		notes = append(notes, exportNote{
+			ID:        n.ID,
+			Title:     n.Title,
+			Workspace: n.WorkspaceName,
+			CreatedAt: n.CreatedAt,
+			UpdatedAt: n.UpdatedAt,
+			File:      fmt.Sprintf("notes/%d-%s.md", n.ID, slugify(n.Title)),
+			content:   n.Content,
+		})
+	}
+
+	shared, err := h.Store.AuthoredShareLinks(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	links := make([]exportShareLink, 0, len(shared))
+	for _, l := range shared {
+		links = append(links, exportShareLink{
+			NoteID:    l.NoteID,
+			URL:       "/share/" + l.Token,
+			Enabled:   l.Enabled,
+			CreatedAt: l.CreatedAt,
+		})
+	}
+
+	profile := gin.H{
+		"userId":      userID,
+		"email":       u.Email,
+		"displayName": u.DisplayName,
+		"timezone":    u.Timezone,
+		"locale":      u.Locale,
+		"preferences": json.RawMessage(u.Preferences),
+		"isAdmin":     u.IsAdmin,
+		"permissions": perms,
+		"createdAt":   u.CreatedAt,
+		"lastLoginAt": u.LastLoginAt,
+		"exportedAt":  nowRFC3339(),
+	}
+
+	writeAudit(h.Store, c, userID, auditUserExport, auditTarget("user", userID), gin.H{"notes": len(notes)})
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="greynote-export-`+time.Now().UTC().Format("20060102")+`.zip"`)
+	c.Status(http.StatusOK)
+
+	// headers are sent, so failures from here on can only be logged
+	zw := zip.NewWriter(c.Writer)
+	now := time.Now()
+	create := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+	writeJSON := func(name string, v any) error {
+		w, err := create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if err := writeJSON("profile.json", profile); err != nil {
+		requestLogger(c).Error("export failed", "error", err)
+		return
+	}
+	if err := writeJSON("notes.json", notes); err != nil {
+		requestLogger(c).Error("export failed", "error", err)
+		return
+	}
+	if err := writeJSON("share_links.json", links); err != nil {
+		requestLogger(c).Error("export failed", "error", err)
+		return
+	}
+	for _, n := range notes {
+		w, err := create(n.File)
+		if err != nil {
+			requestLogger(c).Error("export failed", "error", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n\n%s\n", n.Title, n.content); err != nil {
+			requestLogger(c).Error("export failed", "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		requestLogger(c).Error("export failed", "error", err)
+	}
+}
+
+type deleteMeReq struct {
+	Password string `json:"password"`
+}
+
+// deleteReauthWindow is how recently an account without a local password
+// must have signed in to delete itself.
+const deleteReauthWindow = 10 * time.Minute
+
+// DELETE /api/me
+// Closes the caller's own account after re-checking their password. Wrong
+// passwords count towards the login lockout. Accounts without a local
+// password (SSO, LDAP) may instead send no password from a session that
+// signed in within deleteReauthWindow.
+func (h *AuthHandlers) DeleteMe(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := getUserID(c)
+
+	var req deleteMeReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+
+	u, err := h.Store.UserByID(ctx, userID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	email := u.Email
+
+	if req.Password == "" {
+		_, hash, err := h.Store.PasswordHash(ctx, email)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if hash != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "password required"})
+			return
+		}
+		fresh, err := h.sessionIsFresh(c)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if !fresh {
+			c.JSON(http.StatusForbidden, gin.H{"error": "sign in again to confirm", "reauth": true})
+			return
+		}
+		h.deleteMe(c, u)
+		return
+	}
+
+	ip := c.ClientIP()
+	wait, err := h.Throttle.Check(ctx, ip, email)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts"})
+		return
+	}
+
+	authedID, err := authenticate(c.Request.Context(), h.Authenticators, email, req.Password)
+	if errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrBadPassword) || (err == nil && authedID != userID) {
+		if err := h.Throttle.RecordFailure(ctx, ip, email, "bad_password"); err != nil {
+			requestLogger(c).Warn("login throttle", "error", err)
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "incorrect password"})
+		return
+	}
+	if err != nil {
+		internalError(c, "auth backend error", err)
+		return
+	}
+	h.deleteMe(c, u)
+}
+
+// sessionIsFresh reports whether the caller's session started with a login
+// less than deleteReauthWindow ago.
+func (h *AuthHandlers) sessionIsFresh(c *gin.Context) (bool, error) {
+	sess, err := h.Store.Session(c.Request.Context(), getSessionID(c))
+	if err != nil {
+		return false, err
+	}
+	created, err := time.Parse(time.RFC3339, sess.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return time.Since(created) < deleteReauthWindow, nil
+}
+
+// deleteMe closes u's account once the caller has proven it is theirs.
+func (h *AuthHandlers) deleteMe(c *gin.Context, u User) {
+	ctx := c.Request.Context()
+	userID, email := u.ID, u.Email
+	if u.IsAdmin {
+		others, err := h.Store.OtherSuperusers(ctx, userID)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if others == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "cannot delete the last superuser"})
+			return
+		}
+	}
+
+	if _, err := h.Store.DeleteUser(ctx, userID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, userID, auditUserSelfDelete, auditTarget("user", userID), gin.H{"email": email})
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(h.Cfg.CookieName, "", -1, "/", "", h.Cfg.CookieSecure, true)
+	c.Status(http.StatusNoContent)
+}
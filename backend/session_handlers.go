@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type sessionDTO struct {
+	ID         int64  `json:"id"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	ExpiresAt  string `json:"expiresAt"`
+	Current    bool   `json:"current"`
+}
+
+func listSessions(ctx context.Context, store Store, userID, currentID int64) ([]sessionDTO, error) {
+	sessions, err := store.ListSessions(ctx, userID, nowRFC3339())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]sessionDTO, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, sessionDTO{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == currentID,
+		})
+	}
+	return out, nil
+}
+
+// GET /api/me/sessions
+func (h *AuthHandlers) ListMySessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	out, err := listSessions(ctx, h.Store, getUserID(c), getSessionID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// DELETE /api/me/sessions/:id
+func (h *AuthHandlers) RevokeMySession(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad session id"})
+		return
+	}
+
+	found, err := h.Store.DeleteUserSession(ctx, getUserID(c), sessionID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	// revoking the current session is a logout
+	if sessionID == getSessionID(c) {
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(h.Cfg.CookieName, "", -1, "/", "", h.Cfg.CookieSecure, true)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// POST /api/me/sessions/revoke-others
+func (h *AuthHandlers) RevokeOtherSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	aff, err := h.Store.DeleteUserSessionsExcept(ctx, getUserID(c), getSessionID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": aff})
+}
+
+// GET /api/admin/users/:id/sessions
+func (h *AuthHandlers) ListUserSessionsAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	out, err := listSessions(ctx, h.Store, targetID, getSessionID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// DELETE /api/admin/users/:id/sessions/:sid
+func (h *AuthHandlers) RevokeUserSessionAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("sid"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad session id"})
+		return
+	}
+
+	found, err := h.Store.DeleteUserSession(ctx, targetID, sessionID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditSessionRevoke, auditTarget("user", targetID), gin.H{"sessionId": sessionID})
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/admin/users/:id/sessions
+func (h *AuthHandlers) RevokeUserSessionsAdmin(c *gin.Context) {
+	ctx := c.Request.Context()
+	targetID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || targetID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	// keep the calling admin logged in when they target themselves
+	aff, err := h.Store.DeleteUserSessionsExcept(ctx, targetID, getSessionID(c))
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditSessionRevoke, auditTarget("user", targetID), gin.H{"revoked": aff})
+
+	c.JSON(http.StatusOK, gin.H{"revoked": aff})
+}
@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// sessionExpiry returns when a session created at createdAt expires if it was
+// last used at now: the idle window slides forward with activity but never
+// past the absolute lifetime.
+func sessionExpiry(cfg Config, createdAt, now time.Time) time.Time {
+	exp := now.Add(cfg.SessionTTL)
+	if abs := createdAt.Add(cfg.SessionAbsoluteTTL); abs.Before(exp) {
+		exp = abs
+	}
+	return exp
+}
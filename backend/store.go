@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Store is the persistence layer behind the HTTP handlers and middleware:
+// users and what hangs off them (permissions, sessions, impersonation,
+// password resets, login throttling, avatars, pending SSO logins), notes and
+// share links, access to workspaces, and appending to the audit log.
+// Timestamps are RFC 3339 strings in UTC, as everywhere else in the schema.
+// Lookups that match nothing return ErrNotFound.
+//
+// Role and workspace administration, the audit log viewer, backups and the
+// admin CLI manage their own tables through *sql.DB; their SQL is written to
+// run unchanged on every supported database.
+type Store interface {
+	UserByID(ctx context.Context, id int64) (User, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+	UserByOIDCSubject(ctx context.Context, subject string) (User, error)
+	// CreateUser inserts u and sets u.ID; IsAdmin grants the superuser
+	// role. It fails if the email is already taken.
+	CreateUser(ctx context.Context, u *User, passwordHash string) error
+	// ListUsers returns one page of the users matching q and the total
+	// number of matches.
+	ListUsers(ctx context.Context, q UserQuery) ([]UserSummary, int, error)
+	SetLastLogin(ctx context.Context, userID int64, at string) error
+	// SetUserEmail, SuspendUser, ReactivateUser and DeleteUser report
+	// whether the user existed.
+	SetUserEmail(ctx context.Context, userID int64, email string) (bool, error)
+	SetOIDCSubject(ctx context.Context, userID int64, subject string) error
+	UpdateProfile(ctx context.Context, userID int64, displayName, timezone, locale, preferences string) error
+	// SetSuperuser grants or revokes the superuser role.
+	SetSuperuser(ctx context.Context, userID int64, on bool) error
+	// OtherSuperusers counts the superusers besides userID.
+	OtherSuperusers(ctx context.Context, userID int64) (int, error)
+	// SuspendUser suspends the user, keeping the time of an earlier
+	// suspension, sets when the account is to be deleted ("" for never)
+	// and ends its sessions.
+	SuspendUser(ctx context.Context, userID int64, at, deleteAfter string) (bool, error)
+	// ReactivateUser lifts a suspension and cancels a scheduled deletion.
+	ReactivateUser(ctx context.Context, userID int64) (bool, error)
+	// DeleteUser removes a user with their personal notes, share links and
+	// sessions. Notes they wrote in shared workspaces are kept (see
+	// releaseWorkspaces).
+	DeleteUser(ctx context.Context, userID int64) (bool, error)
+	// UsersDueForDeletion returns the users whose deletion date is not
+	// after now.
+	UsersDueForDeletion(ctx context.Context, now string) ([]int64, error)
+	// UserPermissions returns the union of the permissions of userID's roles.
+	UserPermissions(ctx context.Context, userID int64) ([]string, error)
+
+	// PasswordHash returns the ID and password hash of the user with email.
+	// Accounts without a local password have an empty hash.
+	PasswordHash(ctx context.Context, email string) (int64, string, error)
+	// ReplacePasswordHash stores newHash unless the hash has changed from
+	// oldHash in the meantime.
+	ReplacePasswordHash(ctx context.Context, userID int64, oldHash, newHash string) error
+	// CreatePasswordReset inserts r, replacing the user's earlier link, and
+	// sets r.ID. It returns ErrNotFound if the user does not exist.
+	CreatePasswordReset(ctx context.Context, r *PasswordReset) error
+	// PasswordReset returns the link with tokenHash, provided it expires
+	// after now.
+	PasswordReset(ctx context.Context, tokenHash, now string) (PasswordReset, error)
+	// CompletePasswordReset consumes the link as PasswordReset finds it,
+	// sets the user's password hash and ends their sessions, and returns
+	// the user's ID.
+	CompletePasswordReset(ctx context.Context, tokenHash, now, passwordHash string) (int64, error)
+	PurgeExpiredPasswordResets(ctx context.Context, now string) (int64, error)
+
+	// CreateSession inserts s and sets s.ID.
+	CreateSession(ctx context.Context, s *Session) error
+	Session(ctx context.Context, id int64) (Session, error)
+	// ActiveSession returns the session with token, provided its user is
+	// not suspended. Expiry is left to the caller.
+	ActiveSession(ctx context.Context, token string) (Session, error)
+	TouchSession(ctx context.Context, id int64, lastSeenAt, ip, expiresAt string) error
+	SetSessionCSRFToken(ctx context.Context, id int64, csrfToken string) error
+	// ListSessions returns userID's sessions that expire after now, most
+	// recently used first.
+	ListSessions(ctx context.Context, userID int64, now string) ([]Session, error)
+	DeleteSession(ctx context.Context, id int64) error
+	DeleteSessionByToken(ctx context.Context, token string) error
+	// DeleteUserSession deletes one of userID's sessions and reports
+	// whether it existed.
+	DeleteUserSession(ctx context.Context, userID, id int64) (bool, error)
+	// DeleteUserSessionsExcept deletes all of userID's sessions but keepID
+	// and returns how many it deleted.
+	DeleteUserSessionsExcept(ctx context.Context, userID, keepID int64) (int64, error)
+	PurgeExpiredSessions(ctx context.Context, now string) (int64, error)
+
+	// StartImpersonation inserts imp and sess, the "act as user" session
+	// behind it, and sets imp.ID, sess.ID and sess.ImpersonationID.
+	StartImpersonation(ctx context.Context, imp *Impersonation, sess *Session) error
+	Impersonation(ctx context.Context, id int64) (Impersonation, error)
+	// EndImpersonation sets the end time of an impersonation that has not
+	// ended yet.
+	EndImpersonation(ctx context.Context, id int64, endedAt string) error
+	// ListImpersonations returns the latest impersonations, newest first.
+	ListImpersonations(ctx context.Context, limit int) ([]Impersonation, error)
+
+	// LoginLockout returns the failure counter of one throttling key.
+	LoginLockout(ctx context.Context, kind, value string) (Lockout, error)
+	// LoginLockouts returns every counter, latest failure first.
+	LoginLockouts(ctx context.Context) ([]Lockout, error)
+	// RecordLoginFailure logs a and, in the same transaction, replaces the
+	// counters of the keys it counts against (see lockoutKeys) with next
+	// applied to them. Keys without a counter yet start from zero.
+	RecordLoginFailure(ctx context.Context, a LoginAttempt, next func(Lockout) Lockout) error
+	DeleteLoginLockout(ctx context.Context, kind, value string) error
+	// ClearLoginLockout deletes a counter by ID and returns it.
+	ClearLoginLockout(ctx context.Context, id int64) (Lockout, error)
+	// LoginAttempts returns up to limit attempts, newest first. Empty
+	// email and ip match everything.
+	LoginAttempts(ctx context.Context, email, ip string, limit int) ([]LoginAttempt, error)
+	// PurgeLoginThrottle deletes the counters whose last failure was before
+	// lockoutsBefore and the attempts made before attemptsBefore, and
+	// returns how many rows it deleted.
+	PurgeLoginThrottle(ctx context.Context, lockoutsBefore, attemptsBefore string) (int64, error)
+
+	SaveOIDCState(ctx context.Context, st OIDCState) error
+	// TakeOIDCState deletes and returns a pending SSO login, provided it was
+	// started after notBefore. Older ones are purged along the way.
+	TakeOIDCState(ctx context.Context, state, notBefore string) (OIDCState, error)
+
+	Avatar(ctx context.Context, userID int64) (Avatar, error)
+	// AvatarUpdatedAt returns when userID's avatar last changed, or "" if
+	// they have none.
+	AvatarUpdatedAt(ctx context.Context, userID int64) (string, error)
+	SetAvatar(ctx context.Context, a Avatar) error
+	DeleteAvatar(ctx context.Context, userID int64) error
+
+	// PersonalWorkspace returns userID's personal workspace, creating it
+	// for accounts added since startup.
+	PersonalWorkspace(ctx context.Context, userID int64) (int64, error)
+	// WorkspaceRole returns userID's role in a workspace, or "" if they are
+	// not a member.
+	WorkspaceRole(ctx context.Context, workspaceID, userID int64) (string, error)
+	// NoteRole returns userID's role in the workspace of a note. Notes
+	// outside userID's workspaces are not found.
+	NoteRole(ctx context.Context, noteID, userID int64) (string, error)
+
+	// ListNotes returns a workspace's notes, most recently updated first.
+	ListNotes(ctx context.Context, workspaceID int64) ([]Note, error)
+	Note(ctx context.Context, id int64) (Note, error)
+	// CreateNote inserts n and sets n.ID.
+	CreateNote(ctx context.Context, n *Note) error
+	// UpdateNote and DeleteNote report whether the note existed.
+	UpdateNote(ctx context.Context, id int64, title, content, updatedAt string) (bool, error)
+	DeleteNote(ctx context.Context, id int64) (bool, error)
+	// AuthoredNotes returns the notes userID wrote, oldest first.
+	AuthoredNotes(ctx context.Context, userID int64) ([]AuthoredNote, error)
+
+	// ShareLink returns a note's share link, enabled or not.
+	ShareLink(ctx context.Context, noteID int64) (ShareLink, error)
+	// EnableShareLink re-enables a note's link, or creates one with token
+	// if it has none, and returns it.
+	EnableShareLink(ctx context.Context, noteID int64, token, createdAt string) (ShareLink, error)
+	DisableShareLink(ctx context.Context, noteID int64) error
+	// SharedNote returns the note behind an enabled link. Links of
+	// suspended users resolve to nothing.
+	SharedNote(ctx context.Context, token string) (Note, error)
+	// AuthoredShareLinks returns the links of the notes userID wrote.
+	AuthoredShareLinks(ctx context.Context, userID int64) ([]ShareLink, error)
+
+	// AppendAudit adds e to the append-only audit log, along with the
+	// actor's current email.
+	AppendAudit(ctx context.Context, e AuditEntry) error
+}
+
+type User struct {
+	ID          int64
+	Email       string
+	IsAdmin     bool
+	DisplayName string
+	Timezone    string
+	Locale      string
+	Preferences string // JSON, see Preferences
+	OIDCSubject string
+	SuspendedAt string
+	DeleteAfter string
+	CreatedAt   string
+	LastLoginAt string
+}
+
+// UserQuery selects a page of ListUsers. Search matches part of the email
+// regardless of case; Sort is a key of usersSortColumns.
+type UserQuery struct {
+	Search string
+	Sort   string
+	Desc   bool
+	Limit  int
+	Offset int
+}
+
+type UserSummary struct {
+	User
+	Roles     []string
+	NoteCount int
+}
+
+type PasswordReset struct {
+	ID        int64
+	UserID    int64
+	Email     string // filled in by PasswordReset
+	TokenHash string
+	ExpiresAt string
+	CreatedBy int64 // 0 for the CLI
+	CreatedAt string
+}
+
+type Session struct {
+	ID         int64
+	UserID     int64
+	Token      string
+	CSRFToken  string
+	UserAgent  string
+	IP         string
+	CreatedAt  string
+	LastSeenAt string
+	ExpiresAt  string
+	// ImpersonationID is the impersonations row behind an "act as user"
+	// session, or 0.
+	ImpersonationID int64
+}
+
+type Impersonation struct {
+	ID      int64
+	AdminID int64
+	UserID  int64
+	// AdminSessionID is the session the admin started from, restored when
+	// the impersonation ends.
+	AdminSessionID int64
+	Reason         string
+	IP             string
+	StartedAt      string
+	ExpiresAt      string
+	EndedAt        string
+	// AdminEmail and UserEmail are filled in on reads, and empty once the
+	// account is gone.
+	AdminEmail string
+	UserEmail  string
+}
+
+// Lockout is the failure counter of one throttling key: a client IP or an
+// account email (see lockoutKindIP and lockoutKindEmail).
+type Lockout struct {
+	ID            int64
+	Kind          string
+	Value         string
+	Failures      int
+	LockedUntil   string
+	LastFailureAt string
+}
+
+type LoginAttempt struct {
+	ID        int64
+	Email     string
+	IP        string
+	Reason    string
+	CreatedAt string
+}
+
+// OIDCState is an SSO login waiting for the provider's callback.
+type OIDCState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	CreatedAt    string
+}
+
+type Avatar struct {
+	UserID      int64
+	ContentType string
+	Data        []byte
+	UpdatedAt   string
+}
+
+type Note struct {
+	ID          int64
+	UserID      int64
+	WorkspaceID int64
+	Title       string
+	Content     string
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+type AuthoredNote struct {
+	Note
+	WorkspaceName string
+}
+
+type ShareLink struct {
+	NoteID    int64
+	Token     string
+	Enabled   bool
+	CreatedAt string
+}
+
+type AuditEntry struct {
+	ActorID   int64 // 0 for anonymous requests and the CLI
+	IP        string
+	Action    string
+	Target    string
+	Details   string // JSON
+	CreatedAt string
+}
+
+// sqlStore implements Store on top of database/sql. The same queries serve
+// SQLite and PostgreSQL: placeholders are written as "?" and rewritten by
+// the postgres driver wrapper (see postgres.go), and new IDs come back via
+// RETURNING, which both support.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) Store {
+	return &sqlStore{db: db}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+const userColumns = `id, email, is_admin, display_name, timezone, locale, preferences, COALESCE(oidc_subject, ''),
+	suspended_at, delete_after, created_at, last_login_at`
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	var isAdmin int
+	err := row.Scan(&u.ID, &u.Email, &isAdmin, &u.DisplayName, &u.Timezone, &u.Locale, &u.Preferences, &u.OIDCSubject,
+		&u.SuspendedAt, &u.DeleteAfter, &u.CreatedAt, &u.LastLoginAt)
+	u.IsAdmin = isAdmin == 1
+	return u, err
+}
+
+func (s *sqlStore) UserByID(ctx context.Context, id int64) (User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	return u, notFound(err)
+}
+
+func (s *sqlStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	return u, notFound(err)
+}
+
+func (s *sqlStore) UserByOIDCSubject(ctx context.Context, subject string) (User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE oidc_subject = ?`, subject))
+	return u, notFound(err)
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, u *User, passwordHash string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// oidc_subject is unique where set, so accounts without one store NULL
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO users(email, password_hash, created_at, oidc_subject) VALUES(?,?,?,NULLIF(?, '')) RETURNING id`,
+		u.Email, passwordHash, u.CreatedAt, u.OIDCSubject,
+	).Scan(&u.ID)
+	if err != nil {
+		return err
+	}
+	if u.IsAdmin {
+		if err := setSuperuser(ctx, tx, u.ID, true); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SetLastLogin(ctx context.Context, userID int64, at string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET last_login_at = ? WHERE id = ?`, at, userID)
+	return err
+}
+
+func (s *sqlStore) CreateSession(ctx context.Context, sess *Session) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO sessions(user_id, token, expires_at, created_at, user_agent, ip, last_seen_at, csrf_token, impersonation_id)
+		VALUES(?,?,?,?,?,?,?,?,?) RETURNING id`,
+		sess.UserID, sess.Token, sess.ExpiresAt, sess.CreatedAt, sess.UserAgent, sess.IP,
+		sess.LastSeenAt, sess.CSRFToken, sess.ImpersonationID,
+	).Scan(&sess.ID)
+}
+
+func (s *sqlStore) Session(ctx context.Context, id int64) (Session, error) {
+	var sess Session
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, user_id, token, csrf_token, user_agent, ip, created_at, last_seen_at, expires_at, impersonation_id
+		FROM sessions WHERE id = ?`, id,
+	).Scan(&sess.ID, &sess.UserID, &sess.Token, &sess.CSRFToken, &sess.UserAgent, &sess.IP,
+		&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.ImpersonationID)
+	return sess, notFound(err)
+}
+
+func (s *sqlStore) ActiveSession(ctx context.Context, token string) (Session, error) {
+	var sess Session
+	err := s.db.QueryRowContext(ctx,
+		`SELECT s.id, s.user_id, s.token, s.csrf_token, s.user_agent, s.ip, s.created_at, s.last_seen_at, s.expires_at, s.impersonation_id
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token = ? AND u.suspended_at = ''`, token,
+	).Scan(&sess.ID, &sess.UserID, &sess.Token, &sess.CSRFToken, &sess.UserAgent, &sess.IP,
+		&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.ImpersonationID)
+	return sess, notFound(err)
+}
+
+func (s *sqlStore) TouchSession(ctx context.Context, id int64, lastSeenAt, ip, expiresAt string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET last_seen_at = ?, ip = ?, expires_at = ? WHERE id = ?`,
+		lastSeenAt, ip, expiresAt, id,
+	)
+	return err
+}
+
+func (s *sqlStore) SetSessionCSRFToken(ctx context.Context, id int64, csrfToken string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET csrf_token = ? WHERE id = ?`, csrfToken, id)
+	return err
+}
+
+func (s *sqlStore) ListSessions(ctx context.Context, userID int64, now string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, user_id, token, csrf_token, user_agent, ip, created_at, last_seen_at, expires_at, impersonation_id
+		FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_seen_at DESC, id DESC`,
+		userID, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Session
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.UserID, &sess.Token, &sess.CSRFToken, &sess.UserAgent, &sess.IP,
+			&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.ImpersonationID); err != nil {
+			return nil, err
+		}
+		out = append(out, sess)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) DeleteSession(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqlStore) DeleteSessionByToken(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE token = ?`, token)
+	return err
+}
+
+func (s *sqlStore) DeleteUserSession(ctx context.Context, userID, id int64) (bool, error) {
+	return s.execAffected(ctx, `DELETE FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+func (s *sqlStore) DeleteUserSessionsExcept(ctx context.Context, userID, keepID int64) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) PurgeExpiredSessions(ctx context.Context, now string) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) PersonalWorkspace(ctx context.Context, userID int64) (int64, error) {
+	return ensurePersonalWorkspace(ctx, s.db, userID)
+}
+
+func (s *sqlStore) WorkspaceRole(ctx context.Context, workspaceID, userID int64) (string, error) {
+	return workspaceRole(ctx, s.db, workspaceID, userID)
+}
+
+func (s *sqlStore) NoteRole(ctx context.Context, noteID, userID int64) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT m.role FROM notes n
+		JOIN workspace_members m ON m.workspace_id = n.workspace_id AND m.user_id = ?
+		WHERE n.id = ?`,
+		userID, noteID,
+	).Scan(&role)
+	return role, notFound(err)
+}
+
+const noteColumns = `id, user_id, workspace_id, title, content, created_at, updated_at`
+
+func scanNote(row interface{ Scan(...any) error }) (Note, error) {
+	var n Note
+	err := row.Scan(&n.ID, &n.UserID, &n.WorkspaceID, &n.Title, &n.Content, &n.CreatedAt, &n.UpdatedAt)
+	return n, err
+}
+
+func (s *sqlStore) ListNotes(ctx context.Context, workspaceID int64) ([]Note, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+noteColumns+` FROM notes WHERE workspace_id = ? ORDER BY updated_at DESC, id DESC`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Note
+	for rows.Next() {
+		n, err := scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) Note(ctx context.Context, id int64) (Note, error) {
+	n, err := scanNote(s.db.QueryRowContext(ctx, `SELECT `+noteColumns+` FROM notes WHERE id = ?`, id))
+	return n, notFound(err)
+}
+
+func (s *sqlStore) CreateNote(ctx context.Context, n *Note) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO notes(user_id, workspace_id, title, content, created_at, updated_at) VALUES(?,?,?,?,?,?) RETURNING id`,
+		n.UserID, n.WorkspaceID, n.Title, n.Content, n.CreatedAt, n.UpdatedAt,
+	).Scan(&n.ID)
+}
+
+func (s *sqlStore) UpdateNote(ctx context.Context, id int64, title, content, updatedAt string) (bool, error) {
+	return s.execAffected(ctx, `UPDATE notes SET title = ?, content = ?, updated_at = ? WHERE id = ?`, title, content, updatedAt, id)
+}
+
+func (s *sqlStore) DeleteNote(ctx context.Context, id int64) (bool, error) {
+	return s.execAffected(ctx, `DELETE FROM notes WHERE id = ?`, id)
+}
+
+func (s *sqlStore) AuthoredNotes(ctx context.Context, userID int64) ([]AuthoredNote, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT n.id, n.user_id, n.workspace_id, n.title, n.content, n.created_at, n.updated_at, COALESCE(w.name, '')
+		FROM notes n LEFT JOIN workspaces w ON w.id = n.workspace_id
+		WHERE n.user_id = ? ORDER BY n.id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AuthoredNote
+	for rows.Next() {
+		var n AuthoredNote
+		if err := rows.Scan(&n.ID, &n.UserID, &n.WorkspaceID, &n.Title, &n.Content, &n.CreatedAt, &n.UpdatedAt, &n.WorkspaceName); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ShareLink(ctx context.Context, noteID int64) (ShareLink, error) {
+	l := ShareLink{NoteID: noteID}
+	var enabled int
+	err := s.db.QueryRowContext(ctx, `SELECT token, is_enabled, created_at FROM share_links WHERE note_id = ?`, noteID).
+		Scan(&l.Token, &enabled, &l.CreatedAt)
+	l.Enabled = enabled == 1
+	return l, notFound(err)
+}
+
+func (s *sqlStore) EnableShareLink(ctx context.Context, noteID int64, token, createdAt string) (ShareLink, error) {
+	l := ShareLink{NoteID: noteID, Enabled: true}
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO share_links(note_id, token, is_enabled, created_at) VALUES(?,?,1,?)
+		ON CONFLICT(note_id) DO UPDATE SET is_enabled = 1
+		RETURNING token, created_at`,
+		noteID, token, createdAt,
+	).Scan(&l.Token, &l.CreatedAt)
+	return l, err
+}
+
+func (s *sqlStore) DisableShareLink(ctx context.Context, noteID int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE share_links SET is_enabled = 0 WHERE note_id = ?`, noteID)
+	return err
+}
+
+func (s *sqlStore) SharedNote(ctx context.Context, token string) (Note, error) {
+	n, err := scanNote(s.db.QueryRowContext(ctx,
+		`SELECT n.id, n.user_id, n.workspace_id, n.title, n.content, n.created_at, n.updated_at
+		FROM share_links sl
+		JOIN notes n ON n.id = sl.note_id
+		JOIN users u ON u.id = n.user_id
+		WHERE sl.token = ? AND sl.is_enabled = 1 AND u.suspended_at = ''`, token,
+	))
+	return n, notFound(err)
+}
+
+func (s *sqlStore) AuthoredShareLinks(ctx context.Context, userID int64) ([]ShareLink, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT sl.note_id, sl.token, sl.is_enabled, sl.created_at
+		FROM share_links sl JOIN notes n ON n.id = sl.note_id
+		WHERE n.user_id = ? ORDER BY sl.note_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ShareLink
+	for rows.Next() {
+		var l ShareLink
+		var enabled int
+		if err := rows.Scan(&l.NoteID, &l.Token, &enabled, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		l.Enabled = enabled == 1
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) execAffected(ctx context.Context, query string, args ...any) (bool, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
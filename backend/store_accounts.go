@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// The account side of sqlStore: administration, credentials, impersonation,
+// login throttling, SSO state, avatars and the audit log.
+
+// usersSortColumns maps UserQuery.Sort to SQL.
+var usersSortColumns = map[string]string{
+	"id":        "u.id",
+	"email":     "u.email",
+	"createdAt": "u.created_at",
+	"lastLogin": "u.last_login_at",
+	"noteCount": "note_count",
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context, q UserQuery) ([]UserSummary, int, error) {
+	sortCol, ok := usersSortColumns[q.Sort]
+	if !ok {
+		return nil, 0, errors.New("unknown sort " + q.Sort)
+	}
+	order := "ASC"
+	if q.Desc {
+		order = "DESC"
+	}
+
+	where := ``
+	args := []any{}
+	if q.Search != "" {
+		where = ` WHERE LOWER(u.email) LIKE LOWER(?) ESCAPE '\'`
+		args = append(args, "%"+escapeLike(q.Search)+"%")
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users u`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT u.id, u.email, u.is_admin, u.display_name, u.timezone, u.locale, u.preferences, COALESCE(u.oidc_subject, ''),
+			u.suspended_at, u.delete_after, u.created_at, u.last_login_at,
+			(SELECT COUNT(*) FROM notes n WHERE n.user_id = u.id) AS note_count
+		FROM users u`+where+`
+		ORDER BY `+sortCol+` `+order+`, u.id `+order+`
+		LIMIT ? OFFSET ?`,
+		append(args, q.Limit, q.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	out := []UserSummary{}
+	byID := map[int64]int{}
+	for rows.Next() {
+		var u UserSummary
+		var isAdmin int
+		if err := rows.Scan(&u.ID, &u.Email, &isAdmin, &u.DisplayName, &u.Timezone, &u.Locale, &u.Preferences, &u.OIDCSubject,
+			&u.SuspendedAt, &u.DeleteAfter, &u.CreatedAt, &u.LastLoginAt, &u.NoteCount); err != nil {
+			return nil, 0, err
+		}
+		u.IsAdmin = isAdmin == 1
+		u.Roles = []string{}
+		byID[u.ID] = len(out)
+		out = append(out, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	roleRows, err := s.db.QueryContext(ctx,
+		`SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id IN (SELECT u.id FROM users u`+where+`) ORDER BY r.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer roleRows.Close()
+
+	for roleRows.Next() {
+		var userID int64
+		var name string
+		if err := roleRows.Scan(&userID, &name); err != nil {
+			return nil, 0, err
+		}
+		if i, ok := byID[userID]; ok {
+			out[i].Roles = append(out[i].Roles, name)
+		}
+	}
+	return out, total, roleRows.Err()
+}
+
+func (s *sqlStore) SetUserEmail(ctx context.Context, userID int64, email string) (bool, error) {
+	return s.execAffected(ctx, `UPDATE users SET email = ? WHERE id = ?`, email, userID)
+}
+
+func (s *sqlStore) SetOIDCSubject(ctx context.Context, userID int64, subject string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET oidc_subject = ? WHERE id = ?`, subject, userID)
+	return err
+}
+
+func (s *sqlStore) UpdateProfile(ctx context.Context, userID int64, displayName, timezone, locale, preferences string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE users SET display_name = ?, timezone = ?, locale = ?, preferences = ? WHERE id = ?`,
+		displayName, timezone, locale, preferences, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetSuperuser(ctx context.Context, userID int64, on bool) error {
+	return setSuperuser(ctx, s.db, userID, on)
+}
+
+func (s *sqlStore) OtherSuperusers(ctx context.Context, userID int64) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE is_admin = 1 AND id != ?`, userID).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) SuspendUser(ctx context.Context, userID int64, at, deleteAfter string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET
+			suspended_at = CASE WHEN suspended_at = '' THEN ? ELSE suspended_at END,
+			delete_after = ?
+		WHERE id = ?`,
+		at, deleteAfter, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) ReactivateUser(ctx context.Context, userID int64) (bool, error) {
+	return s.execAffected(ctx, `UPDATE users SET suspended_at = '', delete_after = '' WHERE id = ?`, userID)
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, userID int64) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := releaseWorkspaces(ctx, tx, userID); err != nil {
+		return false, err
+	}
+	for _, q := range []string{
+		`DELETE FROM share_links WHERE note_id IN (SELECT id FROM notes WHERE user_id = ?)`,
+		`DELETE FROM notes WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) UsersDueForDeletion(ctx context.Context, now string) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM users WHERE delete_after != '' AND delete_after <= ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) UserPermissions(ctx context.Context, userID int64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT DISTINCT rp.permission FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = ? ORDER BY rp.permission`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) PasswordHash(ctx context.Context, email string) (int64, string, error) {
+	var id int64
+	var hash string
+	err := s.db.QueryRowContext(ctx, `SELECT id, password_hash FROM users WHERE email = ?`, email).Scan(&id, &hash)
+	return id, hash, notFound(err)
+}
+
+func (s *sqlStore) ReplacePasswordHash(ctx context.Context, userID int64, oldHash, newHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`, newHash, userID, oldHash,
+	)
+	return err
+}
+
+func (s *sqlStore) CreatePasswordReset(ctx context.Context, r *PasswordReset) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dummy int64
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = ?`, r.UserID).Scan(&dummy); err != nil {
+		return notFound(err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM password_resets WHERE user_id = ?`, r.UserID); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO password_resets(user_id, token_hash, expires_at, created_by, created_at) VALUES(?,?,?,?,?) RETURNING id`,
+		r.UserID, r.TokenHash, r.ExpiresAt, r.CreatedBy, r.CreatedAt,
+	).Scan(&r.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) PasswordReset(ctx context.Context, tokenHash, now string) (PasswordReset, error) {
+	var r PasswordReset
+	err := s.db.QueryRowContext(ctx,
+		`SELECT pr.id, pr.user_id, u.email, pr.token_hash, pr.expires_at, pr.created_by, pr.created_at
+		FROM password_resets pr JOIN users u ON u.id = pr.user_id
+		WHERE pr.token_hash = ? AND pr.expires_at > ?`,
+		tokenHash, now,
+	).Scan(&r.ID, &r.UserID, &r.Email, &r.TokenHash, &r.ExpiresAt, &r.CreatedBy, &r.CreatedAt)
+	return r, notFound(err)
+}
+
+func (s *sqlStore) CompletePasswordReset(ctx context.Context, tokenHash, now, passwordHash string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var resetID, userID int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, user_id FROM password_resets WHERE token_hash = ? AND expires_at > ?`, tokenHash, now,
+	).Scan(&resetID, &userID)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM password_resets WHERE id = ?`, resetID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+func (s *sqlStore) PurgeExpiredPasswordResets(ctx context.Context, now string) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM password_resets WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) StartImpersonation(ctx context.Context, imp *Impersonation, sess *Session) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO impersonations(admin_id, user_id, admin_session_id, reason, ip, started_at, expires_at) VALUES(?,?,?,?,?,?,?) RETURNING id`,
+		imp.AdminID, imp.UserID, imp.AdminSessionID, imp.Reason, imp.IP, imp.StartedAt, imp.ExpiresAt,
+	).Scan(&imp.ID)
+	if err != nil {
+		return err
+	}
+
+	sess.ImpersonationID = imp.ID
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO sessions(user_id, token, expires_at, created_at, user_agent, ip, last_seen_at, csrf_token, impersonation_id)
+		VALUES(?,?,?,?,?,?,?,?,?) RETURNING id`,
+		sess.UserID, sess.Token, sess.ExpiresAt, sess.CreatedAt, sess.UserAgent, sess.IP,
+		sess.LastSeenAt, sess.CSRFToken, sess.ImpersonationID,
+	).Scan(&sess.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const impersonationQuery = `SELECT i.id, i.admin_id, i.user_id, i.admin_session_id, i.reason, i.ip,
+	i.started_at, i.expires_at, i.ended_at, COALESCE(a.email, ''), COALESCE(u.email, '')
+	FROM impersonations i
+	LEFT JOIN users a ON a.id = i.admin_id
+	LEFT JOIN users u ON u.id = i.user_id`
+
+func scanImpersonation(row interface{ Scan(...any) error }) (Impersonation, error) {
+	var i Impersonation
+	err := row.Scan(&i.ID, &i.AdminID, &i.UserID, &i.AdminSessionID, &i.Reason, &i.IP,
+		&i.StartedAt, &i.ExpiresAt, &i.EndedAt, &i.AdminEmail, &i.UserEmail)
+	return i, err
+}
+
+func (s *sqlStore) Impersonation(ctx context.Context, id int64) (Impersonation, error) {
+	i, err := scanImpersonation(s.db.QueryRowContext(ctx, impersonationQuery+` WHERE i.id = ?`, id))
+	return i, notFound(err)
+}
+
+func (s *sqlStore) EndImpersonation(ctx context.Context, id int64, endedAt string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE impersonations SET ended_at = ? WHERE id = ? AND ended_at = ''`, endedAt, id)
+	return err
+}
+
+func (s *sqlStore) ListImpersonations(ctx context.Context, limit int) ([]Impersonation, error) {
+	rows, err := s.db.QueryContext(ctx, impersonationQuery+` ORDER BY i.id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Impersonation
+	for rows.Next() {
+		i, err := scanImpersonation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, rows.Err()
+}
+
+const lockoutColumns = `id, kind, value, failures, locked_until, last_failure_at`
+
+func scanLockout(row interface{ Scan(...any) error }) (Lockout, error) {
+	var l Lockout
+	err := row.Scan(&l.ID, &l.Kind, &l.Value, &l.Failures, &l.LockedUntil, &l.LastFailureAt)
+	return l, err
+}
+
+func (s *sqlStore) LoginLockout(ctx context.Context, kind, value string) (Lockout, error) {
+	l, err := scanLockout(s.db.QueryRowContext(ctx,
+		`SELECT `+lockoutColumns+` FROM login_lockouts WHERE kind = ? AND value = ?`, kind, value,
+	))
+	return l, notFound(err)
+}
+
+func (s *sqlStore) LoginLockouts(ctx context.Context) ([]Lockout, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+lockoutColumns+` FROM login_lockouts ORDER BY last_failure_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Lockout
+	for rows.Next() {
+		l, err := scanLockout(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) RecordLoginFailure(ctx context.Context, a LoginAttempt, next func(Lockout) Lockout) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO login_attempts(email, ip, reason, created_at) VALUES(?,?,?,?)`,
+		a.Email, a.IP, a.Reason, a.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	for _, key := range lockoutKeys(a.IP, a.Email) {
+		l, err := scanLockout(tx.QueryRowContext(ctx,
+			`SELECT `+lockoutColumns+` FROM login_lockouts WHERE kind = ? AND value = ?`, key.Kind, key.Value,
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			l = key
+		} else if err != nil {
+			return err
+		}
+
+		l = next(l)
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO login_lockouts(kind, value, failures, locked_until, last_failure_at) VALUES(?,?,?,?,?)
+			ON CONFLICT(kind, value) DO UPDATE SET
+				failures = excluded.failures,
+				locked_until = excluded.locked_until,
+				last_failure_at = excluded.last_failure_at`,
+			key.Kind, key.Value, l.Failures, l.LockedUntil, l.LastFailureAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteLoginLockout(ctx context.Context, kind, value string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM login_lockouts WHERE kind = ? AND value = ?`, kind, value)
+	return err
+}
+
+func (s *sqlStore) ClearLoginLockout(ctx context.Context, id int64) (Lockout, error) {
+	l, err := scanLockout(s.db.QueryRowContext(ctx, `DELETE FROM login_lockouts WHERE id = ? RETURNING `+lockoutColumns, id))
+	return l, notFound(err)
+}
+
+func (s *sqlStore) LoginAttempts(ctx context.Context, email, ip string, limit int) ([]LoginAttempt, error) {
+	q := `SELECT id, email, ip, reason, created_at FROM login_attempts WHERE 1=1`
+	args := []any{}
+	if email != "" {
+		q += ` AND email = ?`
+		args = append(args, email)
+	}
+	if ip != "" {
+		q += ` AND ip = ?`
+		args = append(args, ip)
+	}
+	q += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.Email, &a.IP, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) PurgeLoginThrottle(ctx context.Context, lockoutsBefore, attemptsBefore string) (int64, error) {
+	var total int64
+	for _, q := range []struct {
+		query  string
+		before string
+	}{
+		{`DELETE FROM login_lockouts WHERE last_failure_at < ?`, lockoutsBefore},
+		{`DELETE FROM login_attempts WHERE created_at < ?`, attemptsBefore},
+	} {
+		res, err := s.db.ExecContext(ctx, q.query, q.before)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *sqlStore) SaveOIDCState(ctx context.Context, st OIDCState) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO oidc_states(state, nonce, code_verifier, created_at) VALUES(?,?,?,?)`,
+		st.State, st.Nonce, st.CodeVerifier, st.CreatedAt,
+	)
+	return err
+}
+
+func (s *sqlStore) TakeOIDCState(ctx context.Context, state, notBefore string) (OIDCState, error) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM oidc_states WHERE created_at < ?`, notBefore); err != nil {
+		return OIDCState{}, err
+	}
+	st := OIDCState{State: state}
+	err := s.db.QueryRowContext(ctx,
+		`DELETE FROM oidc_states WHERE state = ? RETURNING nonce, code_verifier, created_at`, state,
+	).Scan(&st.Nonce, &st.CodeVerifier, &st.CreatedAt)
+	return st, notFound(err)
+}
+
+func (s *sqlStore) Avatar(ctx context.Context, userID int64) (Avatar, error) {
+	a := Avatar{UserID: userID}
+	err := s.db.QueryRowContext(ctx, `SELECT content_type, data, updated_at FROM avatars WHERE user_id = ?`, userID).
+		Scan(&a.ContentType, &a.Data, &a.UpdatedAt)
+	return a, notFound(err)
+}
+
+func (s *sqlStore) AvatarUpdatedAt(ctx context.Context, userID int64) (string, error) {
+	var at string
+	err := s.db.QueryRowContext(ctx, `SELECT updated_at FROM avatars WHERE user_id = ?`, userID).Scan(&at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return at, err
+}
+
+func (s *sqlStore) SetAvatar(ctx context.Context, a Avatar) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO avatars(user_id, content_type, data, updated_at) VALUES(?,?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET content_type = excluded.content_type, data = excluded.data, updated_at = excluded.updated_at`,
+		a.UserID, a.ContentType, a.Data, a.UpdatedAt,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteAvatar(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM avatars WHERE user_id = ?`, userID)
+	return err
+}
+
+func (s *sqlStore) AppendAudit(ctx context.Context, e AuditEntry) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO audit_log(actor_id, actor_email, action, target, ip, created_at, details)
+		VALUES(?, COALESCE((SELECT email FROM users WHERE id = ?), ''), ?, ?, ?, ?, ?)`,
+		e.ActorID, e.ActorID, e.Action, e.Target, e.IP, e.CreatedAt, e.Details,
+	)
+	return err
+}
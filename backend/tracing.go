@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracing, enabled with TRACING_EXPORTER. Each request gets a
+// server span, continuing the caller's trace when it sends a traceparent
+// header, and every SQL statement run on the request's context becomes a
+// child span (see observeQuery). Statements run outside a request, such as
+// background jobs, are not traced.
+
+var tracer = otel.Tracer("greynote")
+
+// setupTracing installs the global tracer provider and propagator. The
+// returned function flushes spans that have not been exported yet.
+func setupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.TracingExporter {
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.TracingOTLPEndpoint))
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("greynote")),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("tracing", "error", err)
+	}))
+	return tp.Shutdown, nil
+}
+
+// Tracing starts the request's server span and puts it in the request's
+// context, where handlers pass it on to their queries.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(loggedPath(c)),
+				semconv.ClientAddress(c.ClientIP()),
+				attribute.String("request.id", requestID(c)),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if userID := getUserID(c); userID != 0 {
+			span.SetAttributes(semconv.EnduserID(strconv.FormatInt(userID, 10)))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traceQuery records a finished SQL statement as a child of the span in
+// ctx, if that span is being recorded.
+func traceQuery(ctx context.Context, system attribute.KeyValue, query string, start time.Time, err error) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	op, _, _ := strings.Cut(query, " ")
+	op = strings.ToUpper(op)
+
+	_, span := tracer.Start(ctx, op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(system, semconv.DBOperationName(op), semconv.DBQueryText(query)),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notes belong to workspaces. Every user has a personal workspace
+// (personal_user_id set) that only they can be a member of; shared
+// workspaces gain members through invitation links.
+
+// Workspace roles, weakest first.
+const (
+	wsRoleViewer = "viewer"
+	wsRoleEditor = "editor"
+	wsRoleOwner  = "owner"
+)
+
+var wsRoleRank = map[string]int{wsRoleViewer: 1, wsRoleEditor: 2, wsRoleOwner: 3}
+
+// wsRoleAtLeast reports whether role grants everything min does. The empty
+// role (not a member) grants nothing.
+func wsRoleAtLeast(role, min string) bool {
+	return wsRoleRank[role] > 0 && wsRoleRank[role] >= wsRoleRank[min]
+}
+
+// backfillPersonalWorkspaces gives every user a personal workspace and moves
+// notes from before workspaces existed into their author's.
+func backfillPersonalWorkspaces(db *sql.DB) error {
+	now := nowRFC3339()
+	stmts := []string{
+		`INSERT INTO workspaces(name, personal_user_id, created_at)
+		SELECT 'Personal', u.id, ? FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM workspaces w WHERE w.personal_user_id = u.id)`,
+		`INSERT INTO workspace_members(workspace_id, user_id, role, created_at)
+		SELECT w.id, w.personal_user_id, 'owner', ? FROM workspaces w
+		WHERE w.personal_user_id IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id AND m.user_id = w.personal_user_id
+		)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s, now); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(
+		`UPDATE notes SET workspace_id = (SELECT w.id FROM workspaces w WHERE w.personal_user_id = notes.user_id)
+		WHERE workspace_id = 0`,
+	)
+	return err
+}
+
+// ensurePersonalWorkspace returns userID's personal workspace, creating it
+// for accounts added since startup.
+func ensurePersonalWorkspace(ctx context.Context, db *sql.DB, userID int64) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, `SELECT id FROM workspaces WHERE personal_user_id = ?`, userID).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := nowRFC3339()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO workspaces(name, personal_user_id, created_at) VALUES('Personal', ?, ?) ON CONFLICT(personal_user_id) DO NOTHING`,
+		userID, now,
+	); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM workspaces WHERE personal_user_id = ?`, userID).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO workspace_members(workspace_id, user_id, role, created_at) VALUES(?,?,?,?) ON CONFLICT DO NOTHING`,
+		id, userID, wsRoleOwner, now,
+	); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// workspaceRole returns userID's role in workspaceID, or "" if they are not
+// a member.
+func workspaceRole(ctx context.Context, db *sql.DB, workspaceID, userID int64) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx,
+		`SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?`, workspaceID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// releaseWorkspaces prepares for deleting userID: shared workspaces they
+// alone own pass to their longest-standing other member, or are deleted if
+// there is none, and notes they wrote in shared workspaces are reassigned to
+// an owner so they survive the account.
+func releaseWorkspaces(ctx context.Context, tx *sql.Tx, userID int64) error {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT m.workspace_id FROM workspace_members m JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = ? AND m.role = 'owner' AND w.personal_user_id IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM workspace_members o
+			WHERE o.workspace_id = m.workspace_id AND o.role = 'owner' AND o.user_id != m.user_id
+		)`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	orphaned := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		orphaned = append(orphaned, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, wsID := range orphaned {
+		var heir int64
+		err := tx.QueryRowContext(ctx,
+			`SELECT user_id FROM workspace_members WHERE workspace_id = ? AND user_id != ?
+			ORDER BY created_at, user_id LIMIT 1`,
+			wsID, userID,
+		).Scan(&heir)
+		if err == sql.ErrNoRows {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM notes WHERE workspace_id = ?`, wsID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM workspaces WHERE id = ?`, wsID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE workspace_members SET role = 'owner' WHERE workspace_id = ? AND user_id = ?`, wsID, heir,
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE notes SET user_id = (
+			SELECT o.user_id FROM workspace_members o
+			WHERE o.workspace_id = notes.workspace_id AND o.role = 'owner' AND o.user_id != ?
+			ORDER BY o.created_at, o.user_id LIMIT 1
+		)
+		WHERE user_id = ? AND workspace_id IN (
+			SELECT o.workspace_id FROM workspace_members o JOIN workspaces w ON w.id = o.workspace_id
+			WHERE o.role = 'owner' AND o.user_id != ? AND w.personal_user_id IS NULL
+		)`,
+		userID, userID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the personal workspace itself goes with the user (ON DELETE CASCADE)
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM notes WHERE workspace_id IN (SELECT id FROM workspaces WHERE personal_user_id = ?)`, userID,
+	)
+	return err
+}
+
+func purgeExpiredInvitations(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, `DELETE FROM workspace_invitations WHERE expires_at <= ?`, nowRFC3339())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type WorkspaceHandlers struct {
+	DB    *sql.DB
+	Store Store
+	Cfg   Config
+}
+
+func NewWorkspaceHandlers(db *sql.DB, store Store, cfg Config) *WorkspaceHandlers {
+	return &WorkspaceHandlers{DB: db, Store: store, Cfg: cfg}
+}
+
+type workspaceDTO struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Personal    bool   `json:"personal"`
+	Role        string `json:"role"`
+	MemberCount int    `json:"memberCount"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+type workspaceReq struct {
+	Name string `json:"name"`
+}
+
+type memberRoleReq struct {
+	Role string `json:"role"`
+}
+
+type inviteReq struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// access parses :id and checks the caller holds at least min in that
+// workspace. Non-members get 404 so workspace IDs do not leak. It writes the
+// error response itself and returns 0 in that case.
+func (h *WorkspaceHandlers) access(c *gin.Context, min string) (id int64, personal bool) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad workspace id"})
+		return 0, false
+	}
+
+	var role string
+	var personalUser sql.NullInt64
+	err = h.DB.QueryRowContext(ctx,
+		`SELECT m.role, w.personal_user_id FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id AND m.user_id = ?
+		WHERE w.id = ?`,
+		getUserID(c), id,
+	).Scan(&role, &personalUser)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "workspace not found"})
+		return 0, false
+	}
+	if err != nil {
+		internalError(c, "db error", err)
+		return 0, false
+	}
+	if !wsRoleAtLeast(role, min) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "requires " + min + " role"})
+		return 0, false
+	}
+	return id, personalUser.Valid
+}
+
+// shared is access for operations that make no sense on a personal
+// workspace, such as managing members.
+func (h *WorkspaceHandlers) shared(c *gin.Context, min string) int64 {
+	id, personal := h.access(c, min)
+	if id != 0 && personal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "personal workspaces cannot be shared"})
+		return 0
+	}
+	return id
+}
+
+func (h *WorkspaceHandlers) ownerCount(ctx context.Context, wsID int64) (int, error) {
+	var n int
+	err := h.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND role = 'owner'`, wsID).Scan(&n)
+	return n, err
+}
+
+// GET /api/workspaces
+func (h *WorkspaceHandlers) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := getUserID(c)
+	if _, err := h.Store.PersonalWorkspace(ctx, userID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT w.id, w.name, w.personal_user_id IS NOT NULL, m.role, w.created_at,
+			(SELECT COUNT(*) FROM workspace_members x WHERE x.workspace_id = w.id)
+		FROM workspace_members m JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = ?
+		ORDER BY w.personal_user_id IS NULL, w.name, w.id`,
+		userID,
+	)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer rows.Close()
+
+	out := []workspaceDTO{}
+	for rows.Next() {
+		var w workspaceDTO
+		if err := rows.Scan(&w.ID, &w.Name, &w.Personal, &w.Role, &w.CreatedAt, &w.MemberCount); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		out = append(out, w)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// POST /api/workspaces
+func (h *WorkspaceHandlers) Create(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req workspaceReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	now := nowRFC3339()
+	var id int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO workspaces(name, created_at) VALUES(?,?) RETURNING id`, req.Name, now).Scan(&id)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO workspace_members(workspace_id, user_id, role, created_at) VALUES(?,?,?,?)`,
+		id, getUserID(c), wsRoleOwner, now,
+	); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditWorkspaceCreate, auditTarget("workspace", id), gin.H{"name": req.Name})
+
+	c.JSON(http.StatusCreated, gin.H{"id": id})
+}
+
+// PATCH /api/workspaces/:id
+func (h *WorkspaceHandlers) Update(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, _ := h.access(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+
+	var req workspaceReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
+		return
+	}
+
+	if _, err := h.DB.ExecContext(ctx, `UPDATE workspaces SET name = ? WHERE id = ?`, req.Name, id); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/workspaces/:id
+// Deletes the workspace with all of its notes.
+func (h *WorkspaceHandlers) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := h.shared(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// share links go with their notes (ON DELETE CASCADE)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM notes WHERE workspace_id = ?`, id); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspaces WHERE id = ?`, id); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditWorkspaceDelete, auditTarget("workspace", id), nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/workspaces/:id/members
+func (h *WorkspaceHandlers) ListMembers(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, _ := h.access(c, wsRoleViewer)
+	if id == 0 {
+		return
+	}
+
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT m.user_id, u.email, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ? ORDER BY m.created_at, m.user_id`,
+		id,
+	)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer rows.Close()
+
+	type row struct {
+		UserID   int64  `json:"userId"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+		JoinedAt string `json:"joinedAt"`
+	}
+
+	out := []row{}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.UserID, &r.Email, &r.Role, &r.JoinedAt); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		out = append(out, r)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// PUT /api/workspaces/:id/members/:userId
+func (h *WorkspaceHandlers) SetMemberRole(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := h.shared(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+	memberID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil || memberID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+	var req memberRoleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if wsRoleRank[req.Role] == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, editor or viewer"})
+		return
+	}
+
+	current, err := h.Store.WorkspaceRole(ctx, id, memberID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if current == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not a member"})
+		return
+	}
+	if current == wsRoleOwner && req.Role != wsRoleOwner {
+		n, err := h.ownerCount(ctx, id)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if n <= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a workspace needs at least one owner"})
+			return
+		}
+	}
+
+	if _, err := h.DB.ExecContext(ctx,
+		`UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?`, req.Role, id, memberID,
+	); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditWorkspaceMemberRole, auditTarget("workspace", id),
+		gin.H{"userId": memberID, "role": req.Role})
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/workspaces/:id/members/:userId
+// Owners can remove anyone; other members can only remove themselves.
+func (h *WorkspaceHandlers) RemoveMember(c *gin.Context) {
+	ctx := c.Request.Context()
+	memberID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil || memberID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+	min := wsRoleOwner
+	if memberID == getUserID(c) {
+		min = wsRoleViewer
+	}
+	id := h.shared(c, min)
+	if id == 0 {
+		return
+	}
+
+	current, err := h.Store.WorkspaceRole(ctx, id, memberID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if current == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not a member"})
+		return
+	}
+	if current == wsRoleOwner {
+		n, err := h.ownerCount(ctx, id)
+		if err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		if n <= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a workspace needs at least one owner"})
+			return
+		}
+	}
+
+	if _, err := h.DB.ExecContext(ctx, `DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?`, id, memberID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditWorkspaceMemberRemove, auditTarget("workspace", id), gin.H{"userId": memberID})
+
+	c.Status(http.StatusNoContent)
+}
+
+// POST /api/workspaces/:id/invitations
+// Returns a one-time link for the invited email address, replacing any
+// pending invitation for it.
+func (h *WorkspaceHandlers) Invite(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := h.shared(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+
+	var req inviteReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	req.Email = strings.TrimSpace(strings.ToLower(req.Email))
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid email required"})
+		return
+	}
+	if wsRoleRank[req.Role] == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, editor or viewer"})
+		return
+	}
+
+	var dummy int64
+	err := h.DB.QueryRowContext(ctx,
+		`SELECT m.user_id FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ? AND u.email = ?`, id, req.Email,
+	).Scan(&dummy)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "already a member"})
+		return
+	}
+	if err != sql.ErrNoRows {
+		internalError(c, "db error", err)
+		return
+	}
+
+	token, err := randomTokenURLSafe(32)
+	if err != nil {
+		internalError(c, "token error", err)
+		return
+	}
+	expiresAt := time.Now().UTC().Add(h.Cfg.WorkspaceInviteTTL).Format(time.RFC3339)
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_invitations WHERE workspace_id = ? AND email = ?`, id, req.Email); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	var invID int64
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO workspace_invitations(workspace_id, email, role, token_hash, invited_by, created_at, expires_at) VALUES(?,?,?,?,?,?,?) RETURNING id`,
+		id, req.Email, req.Role, hashToken(token), getUserID(c), nowRFC3339(), expiresAt,
+	).Scan(&invID)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, getUserID(c), auditWorkspaceInvite, auditTarget("workspace", id),
+		gin.H{"email": req.Email, "role": req.Role})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        invID,
+		"inviteUrl": "/invite/" + token,
+		"expiresAt": expiresAt,
+	})
+}
+
+// GET /api/workspaces/:id/invitations (pending only)
+func (h *WorkspaceHandlers) ListInvitations(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := h.shared(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT i.id, i.email, i.role, COALESCE(u.email, ''), i.created_at, i.expires_at
+		FROM workspace_invitations i LEFT JOIN users u ON u.id = i.invited_by
+		WHERE i.workspace_id = ? AND i.expires_at > ? ORDER BY i.id`,
+		id, nowRFC3339(),
+	)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer rows.Close()
+
+	type row struct {
+		ID        int64  `json:"id"`
+		Email     string `json:"email"`
+		Role      string `json:"role"`
+		InvitedBy string `json:"invitedBy"`
+		CreatedAt string `json:"createdAt"`
+		ExpiresAt string `json:"expiresAt"`
+	}
+
+	out := []row{}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.ID, &r.Email, &r.Role, &r.InvitedBy, &r.CreatedAt, &r.ExpiresAt); err != nil {
+			internalError(c, "db error", err)
+			return
+		}
+		out = append(out, r)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// DELETE /api/workspaces/:id/invitations/:invId
+func (h *WorkspaceHandlers) RevokeInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := h.shared(c, wsRoleOwner)
+	if id == 0 {
+		return
+	}
+	invID, err := strconv.ParseInt(c.Param("invId"), 10, 64)
+	if err != nil || invID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad invitation id"})
+		return
+	}
+
+	res, err := h.DB.ExecContext(ctx, `DELETE FROM workspace_invitations WHERE id = ? AND workspace_id = ?`, invID, id)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	aff, _ := res.RowsAffected()
+	if aff == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// lookupInvitation finds the unexpired invitation for :token.
+func (h *WorkspaceHandlers) lookupInvitation(c *gin.Context) (invID, wsID int64, email, role, wsName string, err error) {
+	ctx := c.Request.Context()
+	err = h.DB.QueryRowContext(ctx,
+		`SELECT i.id, i.workspace_id, i.email, i.role, w.name
+		FROM workspace_invitations i JOIN workspaces w ON w.id = i.workspace_id
+		WHERE i.token_hash = ? AND i.expires_at > ?`,
+		hashToken(c.Param("token")), nowRFC3339(),
+	).Scan(&invID, &wsID, &email, &role, &wsName)
+	return
+}
+
+// GET /api/invitations/:token
+func (h *WorkspaceHandlers) GetInvitation(c *gin.Context) {
+	_, wsID, email, role, wsName, err := h.lookupInvitation(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation invalid or expired"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"workspaceId":   wsID,
+		"workspaceName": wsName,
+		"email":         email,
+		"role":          role,
+	})
+}
+
+// POST /api/invitations/:token/accept
+// Only the account the invitation was addressed to can accept it.
+func (h *WorkspaceHandlers) AcceptInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	invID, wsID, email, role, _, err := h.lookupInvitation(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation invalid or expired"})
+		return
+	}
+
+	userID := getUserID(c)
+	var myEmail string
+	if err := h.DB.QueryRowContext(ctx, `SELECT email FROM users WHERE id = ?`, userID).Scan(&myEmail); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if myEmail != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "invitation is for a different account"})
+		return
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_invitations WHERE id = ?`, invID); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO workspace_members(workspace_id, user_id, role, created_at) VALUES(?,?,?,?) ON CONFLICT DO NOTHING`,
+		wsID, userID, role, nowRFC3339(),
+	); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		internalError(c, "db error", err)
+		return
+	}
+	writeAudit(h.Store, c, userID, auditWorkspaceJoin, auditTarget("workspace", wsID), gin.H{"role": role})
+
+	c.JSON(http.StatusOK, gin.H{"workspaceId": wsID})
+}
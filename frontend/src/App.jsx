@@ -1,4 +1,4 @@
-import React from "react";
+import React, { useEffect } from "react";
 import { BrowserRouter, Routes, Route, Navigate, Link } from "react-router-dom";
 import { AuthProvider, useAuth } from "./auth";
 import Login from "./pages/Login";
@@ -7,18 +7,39 @@ import Notes from "./pages/Notes";
 import NoteEdit from "./pages/NoteEdit";
 import ShareView from "./pages/ShareView";
 import AdminUsers from "./pages/AdminUsers";
+import ResetPassword from "./pages/ResetPassword";
+import Workspace from "./pages/Workspace";
+import AcceptInvite from "./pages/AcceptInvite";
+import Account from "./pages/Account";
 
 function Shell({ children }) {
-    const { me, loading, logout } = useAuth();
+    const { me, loading, logout, endImpersonation } = useAuth();
+    const theme = me?.preferences?.theme || "system";
+
+    useEffect(() => {
+        document.documentElement.style.colorScheme = theme === "system" ? "light dark" : theme;
+    }, [theme]);
+
     return (
         <div style={{ maxWidth: 900, margin: "0 auto", padding: 16, fontFamily: "system-ui" }}>
+            {me?.impersonator && (
+                <div style={{ display: "flex", gap: 12, alignItems: "center", padding: 8, marginBottom: 12, background: "#fff3cd", border: "1px solid #e0c97f", borderRadius: 6 }}>
+                    <span>
+                        {me.impersonator.email} acting as <b>{me.email}</b> until{" "}
+                        {new Date(me.impersonationExpiresAt).toLocaleTimeString()}
+                    </span>
+                    <button onClick={endImpersonation} style={{ marginLeft: "auto" }}>
+                        Stop
+                    </button>
+                </div>
+            )}
             <header style={{ display: "flex", gap: 12, alignItems: "center", marginBottom: 16 }}>
                 <Link to="/" style={{ fontWeight: 700, textDecoration: "none" }}>
                     Notes
                 </Link>
 
                 {/* Admin-only nav item */}
-                {loading ? null : me?.isAdmin ? (
+                {loading ? null : me?.permissions?.some((p) => p === "*" || p === "users.read") ? (
                     <Link to="/admin/users" style={{ textDecoration: "none" }}>
                         Users
                     </Link>
@@ -27,7 +48,7 @@ function Shell({ children }) {
                 <div style={{ marginLeft: "auto" }}>
                     {loading ? null : me ? (
                         <>
-                            <span style={{ marginRight: 12 }}>{me.email}</span>
+                            <Link to="/account" style={{ marginRight: 12 }}>{me.displayName || me.email}</Link>
                             <button onClick={logout}>Logout</button>
                         </>
                     ) : (
@@ -54,6 +75,7 @@ export default function App() {
                 <Shell>
                     <Routes>
                         <Route path="/login" element={<Login />} />
+                        <Route path="/reset-password/:token" element={<ResetPassword />} />
                         {/*<Route path="/register" element={<Register />} />*/}
                         <Route
                             path="/admin/users"
@@ -71,6 +93,30 @@ export default function App() {
                                 </RequireAuth>
                             }
                         />
+                        <Route
+                            path="/workspaces/:id"
+                            element={
+                                <RequireAuth>
+                                    <Workspace />
+                                </RequireAuth>
+                            }
+                        />
+                        <Route
+                            path="/account"
+                            element={
+                                <RequireAuth>
+                                    <Account />
+                                </RequireAuth>
+                            }
+                        />
+                        <Route
+                            path="/invite/:token"
+                            element={
+                                <RequireAuth>
+                                    <AcceptInvite />
+                                </RequireAuth>
+                            }
+                        />
                         <Route
                             path="/notes/:id"
                             element={
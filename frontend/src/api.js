@@ -1,7 +1,18 @@
+// per-session CSRF token from /api/me, sent on every mutating request
+let csrfToken = "";
+
+export function setCSRFToken(token) {
+    csrfToken = token || "";
+}
+
 export async function apiFetch(path, { method = "GET", body } = {}) {
+    const headers = {};
+    if (body) headers["Content-Type"] = "application/json";
+    if (method !== "GET" && csrfToken) headers["X-CSRF-Token"] = csrfToken;
+
     const res = await fetch(path, {
         method,
-        headers: body ? { "Content-Type": "application/json" } : undefined,
+        headers,
         body: body ? JSON.stringify(body) : undefined,
         credentials: "include", // IMPORTANT: cookie sessions
     });
@@ -15,3 +26,38 @@ export async function apiFetch(path, { method = "GET", body } = {}) {
     if (ct.includes("application/json")) return res.json();
     return null;
 }
+
+// apiDownload is apiFetch for file responses: it saves the body under the
+// server-suggested file name.
+export async function apiDownload(path, { method = "GET" } = {}) {
+    const headers = {};
+    if (method !== "GET" && csrfToken) headers["X-CSRF-Token"] = csrfToken;
+
+    const res = await fetch(path, { method, headers, credentials: "include" });
+    if (!res.ok) {
+        const txt = await res.text().catch(() => "");
+        throw new Error(txt || `HTTP ${res.status}`);
+    }
+
+    const disposition = res.headers.get("content-disposition") || "";
+    const name = /filename="([^"]+)"/.exec(disposition)?.[1] || "download";
+    const url = URL.createObjectURL(await res.blob());
+    const a = document.createElement("a");
+    a.href = url;
+    a.download = name;
+    a.click();
+    URL.revokeObjectURL(url);
+}
+
+// apiUpload sends a multipart form (e.g. a file picked by the user).
+export async function apiUpload(path, formData, { method = "POST" } = {}) {
+    const headers = {};
+    if (csrfToken) headers["X-CSRF-Token"] = csrfToken;
+
+    const res = await fetch(path, { method, headers, body: formData, credentials: "include" });
+    if (!res.ok) {
+        const txt = await res.text().catch(() => "");
+        throw new Error(txt || `HTTP ${res.status}`);
+    }
+    return res.json();
+}
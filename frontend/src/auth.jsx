@@ -1,5 +1,5 @@
 import React, { createContext, useContext, useEffect, useState } from "react";
-import { apiFetch } from "./api";
+import { apiFetch, setCSRFToken } from "./api";
 
 const AuthCtx = createContext(null);
 
@@ -10,9 +10,11 @@ export function AuthProvider({ children }) {
     async function refreshMe() {
         try {
             const m = await apiFetch("/api/me");
+            setCSRFToken(m.csrfToken);
             setMe(m);
             return m;
         } catch {
+            setCSRFToken("");
             setMe(null);
             return null;
         }
@@ -27,8 +29,18 @@ export function AuthProvider({ children }) {
     }
 
     async function logout() {
-        await apiFetch("/api/logout", { method: "POST" });
-        setMe(null);
+        try {
+            await apiFetch("/api/logout", { method: "POST" });
+        } finally {
+            // an expired session is as good as logged out
+            setCSRFToken("");
+            setMe(null);
+        }
+    }
+
+    async function endImpersonation() {
+        await apiFetch("/api/me/impersonation/end", { method: "POST" });
+        await refreshMe();
     }
 
     useEffect(() => {
@@ -39,7 +51,7 @@ export function AuthProvider({ children }) {
     }, []);
 
     return (
-        <AuthCtx.Provider value={{ me, loading, login, logout, refreshMe }}>
+        <AuthCtx.Provider value={{ me, loading, login, logout, refreshMe, endImpersonation }}>
             {children}
         </AuthCtx.Provider>
     );
@@ -0,0 +1,42 @@
+import React, { useEffect, useState } from "react";
+import { useNavigate, useParams } from "react-router-dom";
+import { apiFetch } from "../api";
+
+export default function AcceptInvite() {
+    const { token } = useParams();
+    const nav = useNavigate();
+    const [inv, setInv] = useState(null);
+    const [err, setErr] = useState("");
+
+    useEffect(() => {
+        apiFetch(`/api/invitations/${token}`)
+            .then(setInv)
+            .catch((e) => setErr(e.message));
+    }, [token]);
+
+    async function accept() {
+        setErr("");
+        try {
+            const r = await apiFetch(`/api/invitations/${token}/accept`, { method: "POST" });
+            localStorage.setItem("workspace", String(r.workspaceId));
+            nav("/");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    return (
+        <div>
+            <h2>Workspace invitation</h2>
+            {err && <div style={{ color: "crimson" }}>{err}</div>}
+            {inv && (
+                <div style={{ display: "grid", gap: 8, maxWidth: 420 }}>
+                    <div>
+                        Join <b>{inv.workspaceName}</b> as {inv.role} ({inv.email})
+                    </div>
+                    <button onClick={accept}>Accept</button>
+                </div>
+            )}
+        </div>
+    );
+}
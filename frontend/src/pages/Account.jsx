@@ -0,0 +1,186 @@
+import React, { useEffect, useState } from "react";
+import { useNavigate } from "react-router-dom";
+import { apiDownload, apiFetch, apiUpload, setCSRFToken } from "../api";
+import { useAuth } from "../auth";
+
+export default function Account() {
+    const nav = useNavigate();
+    const { me, refreshMe } = useAuth();
+    const [password, setPassword] = useState("");
+    const [err, setErr] = useState("");
+    const [profile, setProfile] = useState(null);
+    const [saved, setSaved] = useState(false);
+
+    useEffect(() => {
+        apiFetch("/api/me/profile").then(setProfile).catch((e) => setErr(e.message));
+    }, []);
+
+    function edit(field, value) {
+        setSaved(false);
+        setProfile({ ...profile, [field]: value });
+    }
+
+    function editPref(field, value) {
+        edit("preferences", { ...profile.preferences, [field]: value });
+    }
+
+    async function saveProfile() {
+        setErr("");
+        try {
+            const { displayName, timezone, locale, preferences } = profile;
+            await apiFetch("/api/me/profile", { method: "PUT", body: { displayName, timezone, locale, preferences } });
+            await refreshMe();
+            setSaved(true);
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function uploadAvatar(file) {
+        if (!file) return;
+        setErr("");
+        try {
+            const form = new FormData();
+            form.append("avatar", file);
+            const r = await apiUpload("/api/me/avatar", form, { method: "PUT" });
+            setProfile({ ...profile, avatarUrl: r.avatarUrl });
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function removeAvatar() {
+        setErr("");
+        try {
+            await apiFetch("/api/me/avatar", { method: "DELETE" });
+            setProfile({ ...profile, avatarUrl: "" });
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function exportData() {
+        setErr("");
+        try {
+            await apiDownload("/api/me/export", { method: "POST" });
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function deleteAccount() {
+        if (!confirm("Permanently delete your account and personal notes? This cannot be undone.")) return;
+        setErr("");
+        try {
+            // accounts without a password confirm by having just signed in
+            await apiFetch("/api/me", { method: "DELETE", body: profile?.hasPassword === false ? {} : { password } });
+            setCSRFToken("");
+            await refreshMe();
+            nav("/login");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    return (
+        <div style={{ display: "grid", gap: 12 }}>
+            <h2>Account</h2>
+            <div>{me?.email}</div>
+            {err && <div style={{ color: "crimson" }}>{err}</div>}
+
+            {profile && (
+                <div style={{ padding: 12, border: "1px solid #ddd", borderRadius: 8, display: "grid", gap: 8, maxWidth: 420 }}>
+                    <div style={{ fontWeight: 700 }}>Profile</div>
+                    <div style={{ display: "flex", gap: 8, alignItems: "center" }}>
+                        {profile.avatarUrl ? (
+                            <img src={profile.avatarUrl} alt="" style={{ width: 64, height: 64, borderRadius: "50%", objectFit: "cover" }} />
+                        ) : (
+                            <div style={{ width: 64, height: 64, borderRadius: "50%", background: "#ddd" }} />
+                        )}
+                        <input type="file" accept="image/png,image/jpeg,image/gif,image/webp" onChange={(e) => uploadAvatar(e.target.files[0])} />
+                        {profile.avatarUrl && <button onClick={removeAvatar}>Remove</button>}
+                    </div>
+                    <input
+                        placeholder="display name"
+                        value={profile.displayName}
+                        onChange={(e) => edit("displayName", e.target.value)}
+                        style={{ padding: 8 }}
+                    />
+                    <input
+                        placeholder={`time zone, e.g. ${Intl.DateTimeFormat().resolvedOptions().timeZone}`}
+                        value={profile.timezone}
+                        onChange={(e) => edit("timezone", e.target.value)}
+                        style={{ padding: 8 }}
+                    />
+                    <input
+                        placeholder={`locale, e.g. ${navigator.language}`}
+                        value={profile.locale}
+                        onChange={(e) => edit("locale", e.target.value)}
+                        style={{ padding: 8 }}
+                    />
+                    <label>
+                        Open notes in{" "}
+                        <select value={profile.preferences.editorMode || ""} onChange={(e) => editPref("editorMode", e.target.value)}>
+                            <option value="">preview</option>
+                            <option value="edit">editor</option>
+                        </select>
+                    </label>
+                    <label>
+                        Sort notes by{" "}
+                        <select value={profile.preferences.defaultSort || ""} onChange={(e) => editPref("defaultSort", e.target.value)}>
+                            <option value="">last updated</option>
+                            <option value="created">created</option>
+                            <option value="title">title</option>
+                        </select>
+                    </label>
+                    <label>
+                        Theme{" "}
+                        <select value={profile.preferences.theme || ""} onChange={(e) => editPref("theme", e.target.value)}>
+                            <option value="">system</option>
+                            <option value="light">light</option>
+                            <option value="dark">dark</option>
+                        </select>
+                    </label>
+                    <div style={{ display: "flex", gap: 8, alignItems: "center" }}>
+                        <button onClick={saveProfile}>Save profile</button>
+                        {saved && <span style={{ opacity: 0.7 }}>Saved</span>}
+                    </div>
+                </div>
+            )}
+
+            <div style={{ padding: 12, border: "1px solid #ddd", borderRadius: 8, display: "grid", gap: 8 }}>
+                <div style={{ fontWeight: 700 }}>Export your data</div>
+                <div style={{ opacity: 0.75 }}>A zip of your profile, the notes you wrote (Markdown) and your share links.</div>
+                <button onClick={exportData} style={{ justifySelf: "start" }}>Download export</button>
+            </div>
+
+            <div style={{ padding: 12, border: "1px solid #e0a0a0", borderRadius: 8, display: "grid", gap: 8 }}>
+                <div style={{ fontWeight: 700 }}>Delete account</div>
+                <div style={{ opacity: 0.75 }}>
+                    Deletes your account and personal notes. Notes you wrote in shared workspaces stay with the workspace.
+                </div>
+                {profile?.hasPassword === false ? (
+                    <div style={{ opacity: 0.75 }}>
+                        You sign in through SSO or your directory, so there is no password to confirm with. Sign out and
+                        sign in again, then delete your account within 10 minutes.
+                    </div>
+                ) : (
+                    <input
+                        type="password"
+                        placeholder="confirm with your password"
+                        value={password}
+                        onChange={(e) => setPassword(e.target.value)}
+                        style={{ padding: 8, maxWidth: 320 }}
+                    />
+                )}
+                <button
+                    onClick={deleteAccount}
+                    disabled={!profile || (profile.hasPassword && !password)}
+                    style={{ justifySelf: "start" }}
+                >
+                    Delete my account
+                </button>
+            </div>
+        </div>
+    );
+}
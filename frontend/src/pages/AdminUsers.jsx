@@ -1,17 +1,27 @@
 import React, { useEffect, useMemo, useState } from "react";
 import { useNavigate } from "react-router-dom";
 import { apiFetch } from "../api";
+import { useAuth } from "../auth";
 
 function fmt(dt) {
     try { return new Date(dt).toLocaleString(); } catch { return dt; }
 }
 
+const PAGE_SIZE = 50;
+
+function canReadUsers(me) {
+    return me?.permissions?.some((p) => p === "*" || p === "users.read");
+}
+
 export default function AdminUsers() {
     const nav = useNavigate();
+    const { refreshMe } = useAuth();
 
     const [me, setMe] = useState(null);
     const [users, setUsers] = useState([]);
     const [err, setErr] = useState("");
+    const [q, setQ] = useState("");
+    const [page, setPage] = useState(1);
 
     // create form
     const [email, setEmail] = useState("");
@@ -24,8 +34,9 @@ export default function AdminUsers() {
         return m;
     }
 
-    async function loadUsers() {
-        const list = await apiFetch("/api/admin/users");
+    async function loadUsers(query = q, p = page) {
+        const params = new URLSearchParams({ q: query, page: p, pageSize: PAGE_SIZE });
+        const list = await apiFetch(`/api/admin/users?${params}`);
         setUsers(list);
     }
 
@@ -33,7 +44,7 @@ export default function AdminUsers() {
         setErr("");
         try {
             const m = await loadMe();
-            if (!m.isAdmin) {
+            if (!canReadUsers(m)) {
                 setErr("Admin only");
                 return;
             }
@@ -85,10 +96,43 @@ export default function AdminUsers() {
         }
     }
 
+    async function resetPassword(u) {
+        setErr("");
+        try {
+            const r = await apiFetch(`/api/admin/users/${u.id}/password-reset`, { method: "POST" });
+            window.prompt(`One-time link for ${u.email} (valid until ${fmt(r.expiresAt)})`, window.location.origin + r.resetUrl);
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function impersonate(u) {
+        const reason = window.prompt(`Act as ${u.email}? Reason (recorded):`);
+        if (reason === null) return;
+        setErr("");
+        try {
+            await apiFetch(`/api/admin/users/${u.id}/impersonate`, { method: "POST", body: { reason } });
+            await refreshMe();
+            nav("/");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function goTo(query, p) {
+        setQ(query);
+        setPage(p);
+        try {
+            await loadUsers(query, p);
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
     if (err) return <div style={{ color: "crimson" }}>{err}</div>;
     if (!me) return <div>Loading...</div>;
 
-    if (!me.isAdmin) {
+    if (!canReadUsers(me)) {
         return (
             <div style={{ display: "grid", gap: 10 }}>
                 <div>Admin only.</div>
@@ -129,7 +173,7 @@ export default function AdminUsers() {
                     Admin
                 </label>
 
-                <button onClick={createUser} disabled={!email || password.length < 6}>
+                <button onClick={createUser} disabled={!email || password.length < 8}>
                     Create
                 </button>
             </div>
@@ -137,6 +181,17 @@ export default function AdminUsers() {
             <div style={{ padding: 12, border: "1px solid #ddd", borderRadius: 8 }}>
                 <div style={{ fontWeight: 700, marginBottom: 8 }}>Existing users</div>
 
+                <div style={{ display: "flex", gap: 8, marginBottom: 8 }}>
+                    <input
+                        placeholder="search by email"
+                        value={q}
+                        onChange={(e) => goTo(e.target.value, 1)}
+                        style={{ padding: 8, flex: 1 }}
+                    />
+                    <button onClick={() => goTo(q, page - 1)} disabled={page <= 1}>← Prev</button>
+                    <button onClick={() => goTo(q, page + 1)} disabled={users.length < PAGE_SIZE}>Next →</button>
+                </div>
+
                 <div style={{ display: "grid", gap: 8 }}>
                     {users.map((u) => (
                         <div key={u.id} style={{ display: "grid", gap: 6, padding: 10, border: "1px solid #eee", borderRadius: 8 }}>
@@ -148,6 +203,8 @@ export default function AdminUsers() {
                             <div style={{ display: "flex", gap: 12, opacity: 0.8, fontSize: 12 }}>
                                 <span>Created: {fmt(u.createdAt)}</span>
                                 <span>Role: {u.isAdmin ? "Admin" : "User"}</span>
+                                <span>Last login: {u.lastLoginAt ? fmt(u.lastLoginAt) : "never"}</span>
+                                <span>Notes: {u.noteCount}</span>
                             </div>
 
                             <div style={{ display: "flex", gap: 8 }}>
@@ -158,6 +215,14 @@ export default function AdminUsers() {
                                     {u.isAdmin ? "Remove Admin" : "Make Admin"}
                                 </button>
 
+                                <button onClick={() => resetPassword(u)} disabled={u.id === me.userId}>
+                                    Reset password
+                                </button>
+
+                                <button onClick={() => impersonate(u)} disabled={u.id === me.userId}>
+                                    Act as
+                                </button>
+
                                 <button
                                     onClick={() => deleteUser(u)}
                                     disabled={u.id === me.userId}
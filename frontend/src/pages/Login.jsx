@@ -1,13 +1,20 @@
-import React, { useState } from "react";
-import { Link, useNavigate } from "react-router-dom";
+import React, { useEffect, useState } from "react";
+import { Link, useNavigate, useSearchParams } from "react-router-dom";
 import { useAuth } from "../auth";
+import { apiFetch } from "../api";
 
 export default function Login() {
     const { login } = useAuth();
     const nav = useNavigate();
     const [email, setEmail] = useState("");
     const [password, setPassword] = useState("");
-    const [err, setErr] = useState("");
+    const [params] = useSearchParams();
+    const [err, setErr] = useState(params.get("sso_error") || "");
+    const [methods, setMethods] = useState({ passwordLogin: true, oidc: false });
+
+    useEffect(() => {
+        apiFetch("/api/auth/config").then(setMethods).catch(() => {});
+    }, []);
 
     async function onSubmit(e) {
         e.preventDefault();
@@ -24,11 +31,18 @@ export default function Login() {
         <div>
             <h2>Login</h2>
             {err && <div style={{ color: "crimson" }}>{err}</div>}
-            <form onSubmit={onSubmit} style={{ display: "grid", gap: 8, maxWidth: 360 }}>
-                <input placeholder="email" value={email} onChange={(e) => setEmail(e.target.value)} />
-                <input placeholder="password" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
-                <button type="submit">Login</button>
-            </form>
+            {methods.passwordLogin && (
+                <form onSubmit={onSubmit} style={{ display: "grid", gap: 8, maxWidth: 360 }}>
+                    <input placeholder="email" value={email} onChange={(e) => setEmail(e.target.value)} />
+                    <input placeholder="password" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
+                    <button type="submit">Login</button>
+                </form>
+            )}
+            {methods.oidc && (
+                <p>
+                    <a href="/api/oidc/login">Sign in with SSO</a>
+                </p>
+            )}
             <p style={{ opacity: 0.75, fontSize: 12 }}>
                 New accounts are created by an admin.
             </p>
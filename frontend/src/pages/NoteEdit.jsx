@@ -5,14 +5,16 @@ import remarkGfm from "remark-gfm";
 import rehypeHighlight from "rehype-highlight";
 import "highlight.js/styles/github.css";
 import { apiFetch } from "../api";
+import { useAuth } from "../auth";
 
 export default function NoteEdit() {
     const { id } = useParams();
     const nav = useNavigate();
+    const { me } = useAuth();
     const [note, setNote] = useState(null);
     const [err, setErr] = useState("");
     const [shareUrl, setShareUrl] = useState("");
-    const [preview, setPreview] = useState(true);
+    const [preview, setPreview] = useState(me?.preferences?.editorMode !== "edit");
 
     const fullShareLink = useMemo(() => {
         if (!shareUrl) return "";
@@ -68,12 +70,15 @@ export default function NoteEdit() {
     if (err) return <div style={{ color: "crimson" }}>{err}</div>;
     if (!note) return <div>Loading...</div>;
 
+    const readOnly = note.role === "viewer";
+
     return (
         <div style={{ display: "grid", gap: 10 }}>
             <div style={{ display: "flex", gap: 8 }}>
                 <button onClick={() => nav("/")}>← Back</button>
-                <button onClick={save}>Save</button>
-                <button onClick={del} style={{ marginLeft: "auto" }}>
+                <button onClick={save} disabled={readOnly}>Save</button>
+                {readOnly && <span style={{ opacity: 0.7, alignSelf: "center" }}>Read-only</span>}
+                <button onClick={del} disabled={readOnly} style={{ marginLeft: "auto" }}>
                     Delete
                 </button>
             </div>
@@ -85,13 +90,14 @@ export default function NoteEdit() {
 
             <input
                 value={note.title}
+                readOnly={readOnly}
                 onChange={(e) => setNote({ ...note, title: e.target.value })}
                 style={{ fontSize: 18, padding: 8 }}
             />
 
             {/* Preview toggle */}
             <div style={{ display: "flex", gap: 8, alignItems: "center" }}>
-                <button onClick={() => setPreview(!preview)}>
+                <button onClick={() => setPreview(!preview)} disabled={readOnly}>
                     {preview ? "Edit" : "Preview"}
                 </button>
                 <span style={{ opacity: 0.7, fontSize: 12 }}>
@@ -126,11 +132,11 @@ export default function NoteEdit() {
                         <div style={{ wordBreak: "break-all" }}>{fullShareLink}</div>
                         <div style={{ display: "flex", gap: 8 }}>
                             <button onClick={copyLink}>Copy link</button>
-                            <button onClick={disableShare}>Disable</button>
+                            <button onClick={disableShare} disabled={readOnly}>Disable</button>
                         </div>
                     </div>
                 ) : (
-                    <button onClick={enableShare}>Create share link</button>
+                    <button onClick={enableShare} disabled={readOnly}>Create share link</button>
                 )}
             </div>
         </div>
@@ -1,8 +1,18 @@
 import React, { useEffect, useState } from "react";
 import { Link, useNavigate } from "react-router-dom";
 import { apiFetch } from "../api";
+import { useAuth } from "../auth";
+
+const SORTS = {
+    updated: (a, b) => b.updatedAt.localeCompare(a.updatedAt),
+    created: (a, b) => b.createdAt.localeCompare(a.createdAt),
+    title: (a, b) => a.title.localeCompare(b.title),
+};
 
 export default function Notes() {
+    const { me } = useAuth();
+    const [workspaces, setWorkspaces] = useState([]);
+    const [wsId, setWsId] = useState(() => Number(localStorage.getItem("workspace")) || 0);
     const [notes, setNotes] = useState([]);
     const [err, setErr] = useState("");
     const nav = useNavigate();
@@ -11,27 +21,62 @@ export default function Notes() {
         try { return new Date(dt).toLocaleString(); } catch { return dt; }
     }
 
+    const ws = workspaces.find((w) => w.id === wsId);
+
     async function load() {
         setErr("");
         try {
-            setNotes(await apiFetch("/api/notes"));
+            const list = await apiFetch("/api/workspaces");
+            setWorkspaces(list);
+            const current = list.find((w) => w.id === wsId) || list[0];
+            if (current.id !== wsId) {
+                setWsId(current.id);
+                return;
+            }
+            const found = await apiFetch(`/api/notes?workspace=${current.id}`);
+            setNotes(found.sort(SORTS[me?.preferences?.defaultSort] || SORTS.updated));
         } catch (e) {
             setErr(e.message);
         }
     }
 
+    function pick(id) {
+        localStorage.setItem("workspace", String(id));
+        setWsId(id);
+    }
+
     async function create() {
-        const res = await apiFetch("/api/notes", { method: "POST", body: { title: "New note", content: "" } });
+        const res = await apiFetch("/api/notes", { method: "POST", body: { title: "New note", content: "", workspaceId: wsId } });
         nav(`/notes/${res.id}`);
     }
 
-    useEffect(() => { load(); }, []);
+    async function createWorkspace() {
+        const name = window.prompt("Workspace name");
+        if (!name) return;
+        try {
+            const res = await apiFetch("/api/workspaces", { method: "POST", body: { name } });
+            pick(res.id);
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    useEffect(() => { load(); }, [wsId]);
 
     return (
         <div>
-            <div style={{ display: "flex", alignItems: "center" }}>
-                <h2 style={{ flex: 1 }}>Your notes</h2>
-                <button onClick={create}>+ New</button>
+            <div style={{ display: "flex", alignItems: "center", gap: 8 }}>
+                <select value={wsId} onChange={(e) => pick(Number(e.target.value))} style={{ padding: 6 }}>
+                    {workspaces.map((w) => (
+                        <option key={w.id} value={w.id}>
+                            {w.personal ? "Your notes" : w.name}
+                        </option>
+                    ))}
+                </select>
+                <button onClick={createWorkspace}>+ Workspace</button>
+                {ws && !ws.personal && <Link to={`/workspaces/${ws.id}`}>Members</Link>}
+                <div style={{ flex: 1 }} />
+                <button onClick={create} disabled={!ws || ws.role === "viewer"}>+ New</button>
             </div>
             {err && <div style={{ color: "crimson" }}>{err}</div>}
             <div style={{ display: "grid", gap: 8 }}>
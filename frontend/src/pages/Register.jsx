@@ -26,7 +26,7 @@ export default function Register() {
             {err && <div style={{ color: "crimson" }}>{err}</div>}
             <form onSubmit={onSubmit} style={{ display: "grid", gap: 8, maxWidth: 360 }}>
                 <input placeholder="email" value={email} onChange={(e) => setEmail(e.target.value)} />
-                <input placeholder="password (min 6)" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
+                <input placeholder="password (min 8)" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
                 <button type="submit">Create account</button>
             </form>
             <p>
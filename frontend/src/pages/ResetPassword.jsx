@@ -0,0 +1,42 @@
+import React, { useEffect, useState } from "react";
+import { useNavigate, useParams } from "react-router-dom";
+import { apiFetch } from "../api";
+
+export default function ResetPassword() {
+    const { token } = useParams();
+    const nav = useNavigate();
+    const [email, setEmail] = useState("");
+    const [password, setPassword] = useState("");
+    const [err, setErr] = useState("");
+
+    useEffect(() => {
+        apiFetch(`/api/password-reset/${token}`)
+            .then((r) => setEmail(r.email))
+            .catch((e) => setErr(e.message));
+    }, [token]);
+
+    async function onSubmit(e) {
+        e.preventDefault();
+        setErr("");
+        try {
+            await apiFetch(`/api/password-reset/${token}`, { method: "POST", body: { password } });
+            nav("/login");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    return (
+        <div>
+            <h2>Set password</h2>
+            {err && <div style={{ color: "crimson" }}>{err}</div>}
+            {email && (
+                <form onSubmit={onSubmit} style={{ display: "grid", gap: 8, maxWidth: 360 }}>
+                    <div>{email}</div>
+                    <input placeholder="new password" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
+                    <button type="submit">Set password</button>
+                </form>
+            )}
+        </div>
+    );
+}
@@ -0,0 +1,137 @@
+import React, { useEffect, useState } from "react";
+import { useNavigate, useParams } from "react-router-dom";
+import { apiFetch } from "../api";
+import { useAuth } from "../auth";
+
+const ROLES = ["viewer", "editor", "owner"];
+
+export default function Workspace() {
+    const { id } = useParams();
+    const nav = useNavigate();
+    const { me } = useAuth();
+    const [ws, setWs] = useState(null);
+    const [members, setMembers] = useState([]);
+    const [invites, setInvites] = useState([]);
+    const [email, setEmail] = useState("");
+    const [role, setRole] = useState("editor");
+    const [inviteUrl, setInviteUrl] = useState("");
+    const [err, setErr] = useState("");
+
+    const isOwner = ws?.role === "owner";
+
+    async function load() {
+        setErr("");
+        try {
+            const list = await apiFetch("/api/workspaces");
+            const w = list.find((x) => String(x.id) === id);
+            if (!w) throw new Error("workspace not found");
+            setWs(w);
+            setMembers(await apiFetch(`/api/workspaces/${id}/members`));
+            if (w.role === "owner") setInvites(await apiFetch(`/api/workspaces/${id}/invitations`));
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function run(fn) {
+        setErr("");
+        try {
+            await fn();
+            await load();
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    const setMemberRole = (m, r) =>
+        run(() => apiFetch(`/api/workspaces/${id}/members/${m.userId}`, { method: "PUT", body: { role: r } }));
+
+    const remove = (m) => {
+        if (!confirm(`Remove ${m.email}?`)) return;
+        run(() => apiFetch(`/api/workspaces/${id}/members/${m.userId}`, { method: "DELETE" }));
+    };
+
+    const revoke = (inv) => run(() => apiFetch(`/api/workspaces/${id}/invitations/${inv.id}`, { method: "DELETE" }));
+
+    const invite = () =>
+        run(async () => {
+            const r = await apiFetch(`/api/workspaces/${id}/invitations`, { method: "POST", body: { email, role } });
+            setInviteUrl(window.location.origin + r.inviteUrl);
+            setEmail("");
+        });
+
+    async function leave() {
+        if (!confirm("Leave this workspace?")) return;
+        try {
+            await apiFetch(`/api/workspaces/${id}/members/${me.userId}`, { method: "DELETE" });
+            nav("/");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    async function del() {
+        if (!confirm(`Delete workspace "${ws.name}" and all of its notes?`)) return;
+        try {
+            await apiFetch(`/api/workspaces/${id}`, { method: "DELETE" });
+            nav("/");
+        } catch (e) {
+            setErr(e.message);
+        }
+    }
+
+    useEffect(() => { load(); }, [id]);
+
+    if (!ws) return <div style={{ color: "crimson" }}>{err}</div>;
+
+    return (
+        <div style={{ display: "grid", gap: 12 }}>
+            <div style={{ display: "flex", gap: 8, alignItems: "center" }}>
+                <button onClick={() => nav("/")}>← Back</button>
+                <h2 style={{ flex: 1, margin: 0 }}>{ws.name}</h2>
+                <button onClick={leave}>Leave</button>
+                {isOwner && <button onClick={del}>Delete workspace</button>}
+            </div>
+            {err && <div style={{ color: "crimson" }}>{err}</div>}
+
+            <div style={{ padding: 12, border: "1px solid #ddd", borderRadius: 8, display: "grid", gap: 8 }}>
+                <div style={{ fontWeight: 700 }}>Members</div>
+                {members.map((m) => (
+                    <div key={m.userId} style={{ display: "flex", gap: 8, alignItems: "center" }}>
+                        <span style={{ flex: 1 }}>{m.email}</span>
+                        {isOwner ? (
+                            <select value={m.role} onChange={(e) => setMemberRole(m, e.target.value)}>
+                                {ROLES.map((r) => <option key={r}>{r}</option>)}
+                            </select>
+                        ) : (
+                            <span>{m.role}</span>
+                        )}
+                        {isOwner && m.userId !== me.userId && <button onClick={() => remove(m)}>Remove</button>}
+                    </div>
+                ))}
+            </div>
+
+            {isOwner && (
+                <div style={{ padding: 12, border: "1px solid #ddd", borderRadius: 8, display: "grid", gap: 8 }}>
+                    <div style={{ fontWeight: 700 }}>Invite</div>
+                    <div style={{ display: "flex", gap: 8 }}>
+                        <input placeholder="email" value={email} onChange={(e) => setEmail(e.target.value)} style={{ flex: 1, padding: 6 }} />
+                        <select value={role} onChange={(e) => setRole(e.target.value)}>
+                            {ROLES.map((r) => <option key={r}>{r}</option>)}
+                        </select>
+                        <button onClick={invite} disabled={!email}>Invite</button>
+                    </div>
+                    {inviteUrl && <div style={{ wordBreak: "break-all" }}>Send this link: {inviteUrl}</div>}
+                    {invites.map((inv) => (
+                        <div key={inv.id} style={{ display: "flex", gap: 8, alignItems: "center", fontSize: 14 }}>
+                            <span style={{ flex: 1 }}>
+                                {inv.email} ({inv.role}) — expires {new Date(inv.expiresAt).toLocaleString()}
+                            </span>
+                            <button onClick={() => revoke(inv)}>Revoke</button>
+                        </div>
+                    ))}
+                </div>
+            )}
+        </div>
+    );
+}